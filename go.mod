@@ -9,7 +9,7 @@ require (
 	gopkg.in/yaml.v3 v3.0.1
 )
 
-require github.com/google/uuid v1.3.0 // indirect
+require github.com/google/uuid v1.3.0
 
 require (
 	github.com/andybalholm/brotli v1.0.4 // indirect
@@ -24,7 +24,6 @@ require (
 	github.com/valyala/fasthttp v1.43.0 // indirect
 	github.com/valyala/tcplisten v1.0.0 // indirect
 	github.com/xrash/smetrics v0.0.0-20201216005158-039620a65673 // indirect
-	golang.org/x/exp v0.0.0-20230131120322-dfa7d7a641b0 // indirect
-	golang.org/x/sync v0.1.0
+	golang.org/x/exp v0.0.0-20230131120322-dfa7d7a641b0
 	golang.org/x/sys v0.2.0 // indirect
 )
@@ -18,6 +18,7 @@ func main() {
 		Usage:                  "A utility for orchestrating multiple remote nodes.",
 		Commands: []*cli.Command{
 			node.GetCliCommand(),
+			node.GetSandboxExecCommand(),
 			orchestrator.GetCliCommand(),
 			user.GetCliCommand(),
 		},
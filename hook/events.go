@@ -0,0 +1,57 @@
+package hook
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Names of the server-sent events used to stream job output
+const (
+	EventUpdate = "update"
+	EventDone   = "done"
+)
+
+// Write a single server-sent event with a JSON payload
+func WriteEvent(w io.Writer, event string, id int, payload any) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", id, event, data)
+	return err
+}
+
+// Read server-sent events from r until it is exhausted or fn returns an error
+func ReadEvents(r io.Reader, fn func(event string, data []byte) error) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+
+	event := ""
+	var data []string
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case line == "":
+			if len(data) > 0 {
+				if event == "" {
+					event = "message"
+				}
+				if err := fn(event, []byte(strings.Join(data, "\n"))); err != nil {
+					return err
+				}
+			}
+			event = ""
+			data = nil
+		case strings.HasPrefix(line, ":"):
+			// Comment; used for keep alives
+		case strings.HasPrefix(line, "event:"):
+			event = strings.TrimSpace(strings.TrimPrefix(line, "event:"))
+		case strings.HasPrefix(line, "data:"):
+			data = append(data, strings.TrimPrefix(strings.TrimPrefix(line, "data:"), " "))
+		}
+	}
+	return scanner.Err()
+}
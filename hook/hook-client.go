@@ -3,8 +3,11 @@ package hook
 import (
 	"bytes"
 	"context"
+	"encoding/json"
 	"fmt"
+	"io"
 	"net/http"
+	"sync"
 	"time"
 )
 
@@ -14,19 +17,27 @@ const HookClientReqTimeout = 3 * time.Second
 
 type HookClient struct {
 	Address    string
-	UpdateChan chan []byte
-	outputLog  [][]byte
-	ctx        context.Context
-	cancel     context.CancelFunc
-	isRunning  bool
-	client     *http.Client
+	Job        string
+	UpdateChan chan Update
+	outputLog  []Update
+	seq        int
+	// Updates that didn't fit in UpdateChan since the last one that did
+	dropped int
+	// Set once the listener fails a request; nothing more is sent to it after that
+	failed    error
+	sendMu    sync.Mutex
+	ctx       context.Context
+	cancel    context.CancelFunc
+	isRunning bool
+	client    *http.Client
 }
 
-func NewHookClient(addr string) *HookClient {
+func NewHookClient(addr string, job string) *HookClient {
 	return &HookClient{
 		Address:    addr,
-		UpdateChan: make(chan []byte, HookClientBufferSize),
-		outputLog:  make([][]byte, 0),
+		Job:        job,
+		UpdateChan: make(chan Update, HookClientBufferSize),
+		outputLog:  make([]Update, 0),
 		isRunning:  false,
 		client: &http.Client{
 			Timeout: HookClientReqTimeout,
@@ -34,13 +45,61 @@ func NewHookClient(addr string) *HookClient {
 	}
 }
 
-func (h *HookClient) Send(body []byte) error {
-	if h.isRunning {
-		h.UpdateChan <- body
-		return nil
-	} else {
+// Queue output from the given stream of the index'th command to be sent to the listener.
+// Never waits on the listener: output that doesn't fit in the buffer is dropped and
+// the listener is told how much was lost, and nothing is sent once it has failed.
+func (h *HookClient) Send(stream string, command int, data []byte) error {
+	h.sendMu.Lock()
+	defer h.sendMu.Unlock()
+	if !h.isRunning {
 		return fmt.Errorf("HookClient is not running")
 	}
+	if h.failed != nil {
+		return h.failed
+	}
+	if h.dropped > 0 {
+		if !h.queue(Update{Stream: StreamStatus, Command: command, Data: droppedMessage(h.dropped)}) {
+			h.dropped++
+			return nil
+		}
+		h.dropped = 0
+	}
+	if !h.queue(Update{Stream: stream, Command: command, Data: string(data)}) {
+		h.dropped++
+	}
+	return nil
+}
+
+func droppedMessage(n int) string {
+	return fmt.Sprintf("Listener too slow; dropped %d updates.", n)
+}
+
+// Put an update in the buffer if there's room. Must be called with sendMu held.
+func (h *HookClient) queue(u Update) bool {
+	h.seq++
+	u.Seq = h.seq
+	select {
+	case h.UpdateChan <- u:
+		return true
+	default:
+		h.seq--
+		return false
+	}
+}
+
+// Stop sending to a listener that didn't take a request
+func (h *HookClient) fail(err error) {
+	h.sendMu.Lock()
+	defer h.sendMu.Unlock()
+	if h.failed == nil {
+		h.failed = fmt.Errorf("hook listener at %s failed, not sending it any more output: %w", h.Address, err)
+	}
+}
+
+func (h *HookClient) hasFailed() bool {
+	h.sendMu.Lock()
+	defer h.sendMu.Unlock()
+	return h.failed != nil
 }
 
 func (h *HookClient) Start() error {
@@ -48,18 +107,44 @@ func (h *HookClient) Start() error {
 	h.ctx = c
 	h.cancel = cancel
 
+	h.sendMu.Lock()
 	h.isRunning = true
+	h.sendMu.Unlock()
+	// Let the listener know about the job right away, so a listener shared
+	// with other jobs waits for this one even if it hasn't output anything yet
+	if err := h.sendKeepAlive(); err != nil {
+		h.fail(err)
+	}
 	keepAliveTicker := time.NewTicker(HookClientIdleTimeout)
 	go func() {
 		for {
 			select {
-			case body := <-h.UpdateChan:
-				h.outputLog = append(h.outputLog, body)
-				h.update(body)
+			case u := <-h.UpdateChan:
+				h.forward(u)
 			case <-keepAliveTicker.C:
-				h.sendKeepAlive()
+				if !h.hasFailed() {
+					if err := h.sendKeepAlive(); err != nil {
+						h.fail(err)
+					}
+				}
 			case <-h.ctx.Done():
 				keepAliveTicker.Stop()
+				// Flush anything still queued before telling the listener we're done
+				for len(h.UpdateChan) > 0 {
+					h.forward(<-h.UpdateChan)
+				}
+				h.sendMu.Lock()
+				dropped := h.dropped
+				h.dropped = 0
+				h.seq++
+				seq := h.seq
+				h.sendMu.Unlock()
+				if dropped > 0 {
+					h.forward(Update{Stream: StreamStatus, Seq: seq, Data: droppedMessage(dropped)})
+				}
+				if h.hasFailed() {
+					return
+				}
 				if err := h.finish(); err != nil {
 					fmt.Println(err)
 				}
@@ -70,14 +155,31 @@ func (h *HookClient) Start() error {
 	return nil
 }
 
+// Send an update on to the listener unless it has already failed
+func (h *HookClient) forward(u Update) {
+	h.outputLog = append(h.outputLog, u)
+	if h.hasFailed() {
+		return
+	}
+	if err := h.update(u); err != nil {
+		h.fail(err)
+	}
+}
+
 func (h *HookClient) Stop() {
+	h.sendMu.Lock()
+	defer h.sendMu.Unlock()
 	if h.isRunning {
 		h.cancel()
 	}
 	h.isRunning = false
 }
 
-func (h *HookClient) update(body []byte) error {
+func (h *HookClient) update(u Update) error {
+	body, err := json.Marshal(u)
+	if err != nil {
+		return err
+	}
 	url := fmt.Sprintf("http://%s/update", h.Address)
 	return h.post(url, body)
 }
@@ -98,12 +200,16 @@ func (h *HookClient) post(url string, body []byte) error {
 		fmt.Println(err)
 		return err
 	}
-	req.Header.Set("Content-Type", "text/plain")
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(JobHeader, h.Job)
 
 	resp, err := h.client.Do(req)
 	if err != nil {
 		return err
 	}
+	// Read the body to the end so the connection can be used for the next request
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
 	if resp.StatusCode != http.StatusOK {
 		fmt.Println("Bad request")
 		return fmt.Errorf("hook request not OK: %d", resp.StatusCode)
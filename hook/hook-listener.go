@@ -2,8 +2,12 @@ package hook
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"log"
+	"net"
+	"os"
+	"strings"
 	"sync"
 	"time"
 
@@ -13,15 +17,43 @@ import (
 const HookListenIdleTimeout = 10 * time.Second
 const HookListenShutdownTimeout = 500 * time.Millisecond
 
-type HookListener struct{ ticker *time.Ticker }
+// Header used by hook clients to say which job a request belongs to
+const JobHeader = "X-Gorch-Job"
+
+type HookListener struct {
+	ticker *time.Ticker
+	ln     net.Listener
+	mu     sync.Mutex
+	// Jobs that have talked to the listener, and whether they've finished
+	jobs map[string]bool
+}
 
 func NewHookListener() HookListener {
 	return HookListener{
 		ticker: time.NewTicker(HookListenIdleTimeout),
+		jobs:   map[string]bool{},
+	}
+}
+
+// Bind the listener to a port without serving on it yet
+func (h *HookListener) Bind(port int) error {
+	ln, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		return err
 	}
+	h.ln = ln
+	return nil
 }
 
 func (h *HookListener) Listen(port int) error {
+	if err := h.Bind(port); err != nil {
+		return err
+	}
+	return h.Serve()
+}
+
+// Serve hook requests on the bound port until every job that used it has finished
+func (h *HookListener) Serve() error {
 	var wg sync.WaitGroup
 	ctx, cancel := context.WithCancel(context.Background())
 	done := func() {
@@ -30,7 +62,7 @@ func (h *HookListener) Listen(port int) error {
 	}
 
 	wg.Add(1)
-	go HookServerThread(h, port, ctx, done)
+	go HookServerThread(h, ctx, done)
 
 	wg.Add(1)
 	go h.WatchDog(ctx, done)
@@ -57,7 +89,42 @@ func (h *HookListener) Feed() {
 	h.ticker.Reset(HookListenIdleTimeout)
 }
 
-func HookServerThread(h *HookListener, port int, ctx context.Context, done func()) {
+// Note that a job is using the listener. Returns the prefix its output should be shown with.
+func (h *HookListener) track(job string) string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, ok := h.jobs[job]; !ok {
+		h.jobs[job] = false
+	}
+	return h.prefix(job)
+}
+
+// Mark a job as finished. Returns true once every job that used the listener is done.
+func (h *HookListener) finish(job string) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.jobs[job] = true
+	for _, finished := range h.jobs {
+		if !finished {
+			return false
+		}
+	}
+	return true
+}
+
+// Output is only prefixed once more than one job is sharing the listener.
+// Must be called with the lock held.
+func (h *HookListener) prefix(job string) string {
+	if len(h.jobs) < 2 {
+		return ""
+	}
+	if len(job) > 8 {
+		job = job[:8]
+	}
+	return fmt.Sprintf("[%s] ", job)
+}
+
+func HookServerThread(h *HookListener, ctx context.Context, done func()) {
 	defer done()
 
 	app := fiber.New(fiber.Config{
@@ -70,21 +137,56 @@ func HookServerThread(h *HookListener, port int, ctx context.Context, done func(
 	}()
 
 	app.Post("/update", func(c *fiber.Ctx) error {
-		body := c.Body()
-		fmt.Println(string(body))
+		h.Feed()
+		// Fiber reuses the request's buffers, so the job id has to be copied to outlive it
+		prefix := h.track(strings.Clone(c.Get(JobHeader)))
+		var u Update
+		if err := json.Unmarshal(c.Body(), &u); err != nil {
+			// Not a structured update; show it as is
+			fmt.Println(prefix + string(c.Body()))
+			return c.SendString("ack")
+		}
+		PrintUpdate(prefix, u)
 		return c.SendString("ack")
 	})
 	app.Post("/keepalive", func(c *fiber.Ctx) error {
 		log.Println("Got Keepalive request.")
+		h.track(strings.Clone(c.Get(JobHeader)))
 		h.Feed()
 		return c.SendString("ack")
 	})
 
 	app.Post("/finish", func(c *fiber.Ctx) error {
-		go func() {
-			app.ShutdownWithTimeout(3 * time.Second)
-		}()
+		job := strings.Clone(c.Get(JobHeader))
+		h.track(job)
+		if h.finish(job) {
+			go func() {
+				app.ShutdownWithTimeout(3 * time.Second)
+			}()
+		}
 		return c.SendString("ack")
 	})
-	app.Listen(fmt.Sprintf(":%d", port))
+	app.Listener(h.ln)
+}
+
+// Print an update to the terminal, keeping stderr output on stderr.
+// Every line of the update is started with prefix.
+func PrintUpdate(prefix string, u Update) {
+	data := u.Data
+	if u.Stream == StreamStatus {
+		data = fmt.Sprintf("[gorch] %s\n", data)
+	}
+	if prefix != "" {
+		trailingNewline := strings.HasSuffix(data, "\n")
+		data = prefix + strings.ReplaceAll(strings.TrimSuffix(data, "\n"), "\n", "\n"+prefix)
+		if trailingNewline {
+			data += "\n"
+		}
+	}
+
+	if u.Stream == StreamStderr {
+		fmt.Fprint(os.Stderr, data)
+	} else {
+		fmt.Print(data)
+	}
 }
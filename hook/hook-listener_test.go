@@ -0,0 +1,121 @@
+package hook
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func (h *HookListener) trackedJobs() map[string]bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	jobs := map[string]bool{}
+	for job, finished := range h.jobs {
+		jobs[job] = finished
+	}
+	return jobs
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// Two jobs share a listener while other requests go through it. The listener
+// must keep track of both jobs by their own ids and stop once both are done.
+func TestListenerWaitsForEveryJob(t *testing.T) {
+	h := NewHookListener()
+	if err := h.Bind(0); err != nil {
+		t.Fatal(err)
+	}
+	addr := h.ln.Addr().String()
+	served := make(chan struct{})
+	go func() {
+		h.Serve()
+		close(served)
+	}()
+
+	// Everything goes over one connection, so the server reuses the same buffers for every request
+	client := &http.Client{Transport: &http.Transport{MaxConnsPerHost: 1}}
+	// Requests the listener doesn't know about, with headers the size of a job id
+	unrelated := func(i int) {
+		req, _ := http.NewRequest("POST", fmt.Sprintf("http://%s/unrelated", addr), nil)
+		req.Header.Set(JobHeader, strings.Repeat(fmt.Sprint(i%10), 17))
+		if resp, err := client.Do(req); err == nil {
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		}
+	}
+
+	a := NewHookClient(addr, "job-aaaaaaaa-1111")
+	b := NewHookClient(addr, "job-bbbbbbbb-2222")
+	a.client, b.client = client, client
+	a.Start()
+	unrelated(0)
+	b.Start()
+	for i := 0; i < 20; i++ {
+		a.Send(StreamStdout, 0, []byte(fmt.Sprintf("a %d\n", i)))
+		unrelated(i)
+		b.Send(StreamStderr, 0, []byte(fmt.Sprintf("b %d\n", i)))
+	}
+	waitFor(t, "both jobs to be tracked", func() bool { return len(h.trackedJobs()) == 2 })
+
+	a.Stop()
+	waitFor(t, "the first job to finish", func() bool { return h.trackedJobs()[a.Job] })
+	for i := 0; i < 5; i++ {
+		unrelated(i)
+	}
+	select {
+	case <-served:
+		t.Fatal("the listener stopped while a job was still running")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	jobs := h.trackedJobs()
+	ids := []string{}
+	for job := range jobs {
+		ids = append(ids, job)
+	}
+	sort.Strings(ids)
+	if want := []string{a.Job, b.Job}; strings.Join(ids, ",") != strings.Join(want, ",") {
+		t.Fatalf("tracked jobs %q, want %q", ids, want)
+	}
+	if jobs[b.Job] {
+		t.Error("the second job was marked finished before it was")
+	}
+
+	b.Stop()
+	select {
+	case <-served:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the listener didn't stop after its last job finished")
+	}
+}
+
+func TestListenerPrefixesSharedOutput(t *testing.T) {
+	h := NewHookListener()
+	tests := []struct {
+		job  string
+		want string
+	}{
+		{"job-aaaaaaaa-1111", ""},
+		{"job-bbbbbbbb-2222", "[job-bbbb] "},
+		{"job-aaaaaaaa-1111", "[job-aaaa] "},
+		{"short", "[short] "},
+	}
+	for _, test := range tests {
+		if got := h.track(test.job); got != test.want {
+			t.Errorf("track(%q) = %q, want %q", test.job, got, test.want)
+		}
+	}
+}
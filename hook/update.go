@@ -0,0 +1,16 @@
+package hook
+
+// Names of the streams an update can belong to
+const (
+	StreamStdout = "stdout"
+	StreamStderr = "stderr"
+	StreamStatus = "status"
+)
+
+// A piece of action output sent from a node to a hook listener
+type Update struct {
+	Stream  string `json:"stream"`
+	Command int    `json:"command"`
+	Seq     int    `json:"seq"`
+	Data    string `json:"data"`
+}
@@ -1,16 +1,21 @@
 package node
 
 import (
-	"bytes"
-	"html/template"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"log"
 	"os"
-	"os/exec"
+	"sort"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/bofrim/gorch/hook"
 	"github.com/bofrim/gorch/node/resources"
+	"golang.org/x/exp/maps"
 	"golang.org/x/exp/slog"
 	"gopkg.in/yaml.v3"
 )
@@ -19,95 +24,299 @@ const StreamTeardownDelay = 250 * time.Millisecond
 
 type Action struct {
 	Name        string                    `yaml:"name" json:"name"`
-	Params      []string                  `yaml:"params" json:"params"`
-	Commands    []string                  `yaml:"commands" json:"commands"`
+	Params      Params                    `yaml:"params" json:"params"`
+	Commands    []Command                 `yaml:"commands" json:"commands"`
 	Description string                    `yaml:"description" json:"description"`
 	ResourceReq resources.ResourceRequest `yaml:"resources" json:"resource"`
+	Timeout     Duration                  `yaml:"timeout" json:"timeout"`
+	Shell       string                    `yaml:"shell" json:"shell"`
+	// Actions with a higher priority get resources first when they have to wait
+	Priority int `yaml:"priority" json:"priority"`
+	// Extra environment variables for the commands. Values are templated.
+	Env map[string]string `yaml:"env" json:"env,omitempty"`
+	// Start the commands with the node's environment as well as Env. Defaults to true.
+	InheritEnv *bool `yaml:"inherit-env" json:"inherit_env,omitempty"`
+	// Directory the commands run in. Templated.
+	Workdir string `yaml:"workdir" json:"workdir,omitempty"`
+	// User and group (names or ids) to run the commands as. Needs the node to run as root.
+	User  string `yaml:"user" json:"user,omitempty"`
+	Group string `yaml:"group" json:"group,omitempty"`
+	// File mode creation mask for the commands, in octal (e.g. "027")
+	Umask string `yaml:"umask" json:"umask,omitempty"`
+	// Isolate the commands from the node
+	Sandbox *Sandbox `yaml:"sandbox" json:"sandbox,omitempty"`
+}
+
+// A single command of an action. Can be configured as a plain string, as a
+// list of arguments, or as a mapping when extra options are needed:
+//
+//	commands:
+//	  - "date"
+//	  - ["ls", "-la", "{{.dir}}"]
+//	  - run: "sleep {{.time}}"
+//	    timeout: 10s
+//
+// String commands are run through the action's shell if it has one, otherwise
+// they are split on whitespace. Argument lists are always exec'd directly, with
+// each argument templated on its own so values can't split into extra arguments.
+type Command struct {
+	Run     string   `yaml:"run" json:"run,omitempty"`
+	Args    []string `yaml:"args" json:"args,omitempty"`
+	Timeout Duration `yaml:"timeout" json:"timeout"`
+}
+
+// Avoid recursing into the custom unmarshallers
+type commandFields Command
+
+func (c *Command) UnmarshalYAML(node *yaml.Node) error {
+	switch node.Kind {
+	case yaml.ScalarNode:
+		return node.Decode(&c.Run)
+	case yaml.SequenceNode:
+		return node.Decode(&c.Args)
+	}
+	return node.Decode((*commandFields)(c))
+}
+
+func (c *Command) UnmarshalJSON(data []byte) error {
+	if err := json.Unmarshal(data, &c.Run); err == nil {
+		return nil
+	}
+	if err := json.Unmarshal(data, &c.Args); err == nil {
+		return nil
+	}
+	return json.Unmarshal(data, (*commandFields)(c))
 }
 
 type AdHocAction struct {
 	ActionDef Action `yaml:"action" json:"action"`
 }
 
-func (a Action) BuildCommands(params any) ([]string, error) {
-	commands := make([]string, len(a.Commands))
+// Render every command of the action into the argv that will be exec'd.
+// Errors name the action and the command (and argument) that failed.
+//
+// Param values can't change the shape of a command. String commands run
+// through a shell get each {{ }} as a separate argument to the shell, referred
+// to from the script as "${1}", "${2}", ... Strings that aren't run through a
+// shell are split into arguments the way a shell would before the values are
+// put back, so a value never becomes more than part of one argument.
+// Only params marked unsafe are pasted into the command text as they are.
+func (a Action) BuildCommands(params any) ([][]string, error) {
+	unsafe := a.Params.unsafe()
+	commands := make([][]string, len(a.Commands))
 	for i, command := range a.Commands {
+		if command.Args != nil {
+			args := make([]string, len(command.Args))
+			for j, arg := range command.Args {
+				rendered, err := renderTemplate(a.Name, arg, params)
+				if err != nil {
+					return nil, fmt.Errorf("action %s command %d argument %d: %w", a.Name, i, j, err)
+				}
+				args[j] = rendered
+			}
+			commands[i] = args
+			continue
+		}
 
-		t, err := template.New(a.Name).Parse(command)
+		text, values, err := renderCommand(a.Name, command.Run, params, unsafe)
 		if err != nil {
-			return nil, err
+			return nil, fmt.Errorf("action %s command %d: %w", a.Name, i, err)
 		}
-
-		var b bytes.Buffer
-		if err := t.Execute(&b, params); err != nil {
-			return nil, err
+		if a.Shell != "" {
+			script, err := shellScript(text, len(values))
+			if err != nil {
+				return nil, fmt.Errorf("action %s command %d: %w", a.Name, i, err)
+			}
+			// The values follow $0, which the shell uses as its name in errors
+			commands[i] = append(append(a.shellArgs(), script, a.Name), values...)
+			continue
+		}
+		if commands[i], err = commandArgs(text, values); err != nil {
+			return nil, fmt.Errorf("action %s command %d: %w", a.Name, i, err)
 		}
-		commands[i] = b.String()
 	}
 	return commands, nil
 }
 
-func (a Action) Run(params any) ([]string, error) {
+// The argv prefix used to hand a command string to the action's shell.
+// "-c" is added if the configured shell doesn't already end with it.
+func (a Action) shellArgs() []string {
+	args := strings.Fields(a.Shell)
+	if len(args) > 0 && args[len(args)-1] != "-c" {
+		args = append(args, "-c")
+	}
+	return args
+}
+
+// Run every command of the action in order, stopping at the first one that fails.
+// If output isn't nil, it is given the action's output line by line as it runs.
+func (a Action) Run(ctx context.Context, params any, output OutputFunc) ([]CommandResult, error) {
+	if output == nil {
+		output = func(string, int, []byte) {}
+	}
+
 	commands, err := a.BuildCommands(params)
 	if err != nil {
+		output(hook.StreamStatus, 0, []byte(err.Error()))
 		return nil, err
 	}
+	env, err := a.prepareRun(params)
+	if err != nil {
+		output(hook.StreamStatus, 0, []byte(err.Error()))
+		return nil, err
+	}
+	if env.sandbox != nil {
+		if err := env.sandbox.start(a.ResourceReq); err != nil {
+			err = fmt.Errorf("action %s: %w", a.Name, err)
+			output(hook.StreamStatus, 0, []byte(err.Error()))
+			return nil, err
+		}
+		defer env.sandbox.stop()
+	}
 
-	results := make([]string, len(commands))
-
+	results := []CommandResult{}
 	for i, c := range commands {
-		args := strings.Fields(c)
-		cmd := exec.Command(args[0], args[1:]...)
-		out, err := cmd.CombinedOutput()
-		if err != nil {
-			return nil, err
+		// Don't start anything else once the action has been cancelled
+		if err := ctx.Err(); err != nil {
+			output(hook.StreamStatus, i, []byte(stopReason(err)))
+			return results, err
 		}
-		results[i] = string(out)
 
+		output(hook.StreamStatus, i, []byte("$ "+strings.Join(c, " ")))
+		stdout := newLineWriter(hook.StreamStdout, i, output)
+		stderr := newLineWriter(hook.StreamStderr, i, output)
+		result, err := a.execCommand(ctx, i, c, env, stdout, stderr)
+		stdout.Flush()
+		stderr.Flush()
+		results = append(results, result)
+		if err != nil {
+			if ctx.Err() != nil {
+				output(hook.StreamStatus, i, []byte(stopReason(ctx.Err())))
+			} else {
+				output(hook.StreamStatus, i, []byte(err.Error()))
+			}
+			return results, err
+		}
 	}
 	return results, nil
 }
 
-func (a Action) RunStreamed(streamDest string, params any, logger *slog.Logger) error {
-	commands, err := a.BuildCommands(params)
+// Run the action while streaming its output to a hook listener through hc, which is
+// stopped once the action is done. The output is also given to record if it isn't nil.
+func (a Action) RunStreamed(ctx context.Context, hc *hook.HookClient, params any, record OutputFunc, logger *slog.Logger) ([]CommandResult, error) {
+	defer hc.Stop()
+
+	var reportFailure sync.Once
+	results, err := a.Run(ctx, params, func(stream string, command int, data []byte) {
+		if record != nil {
+			record(stream, command, data)
+		}
+		// The client keeps failing once it has, so only say so once
+		if err := hc.Send(stream, command, data); err != nil {
+			reportFailure.Do(func() {
+				logger.Error("Failed to send output for action command.", err,
+					slog.String("action", a.Name),
+					slog.Int("command", command),
+					slog.String("client", hc.Address),
+				)
+			})
+		}
+	})
 	if err != nil {
-		logger.Error(
-			"Failed to build action command.", err,
+		logger.Error("Error while running action.", err,
 			slog.String("action", a.Name),
 			slog.Any("params", params),
 		)
-		return err
 	}
+	time.Sleep(StreamTeardownDelay)
+	return results, err
+}
 
-	hc := hook.NewHookClient(streamDest)
-	go hc.Start()
-	defer hc.Stop()
-
-	for _, c := range commands {
-		args := strings.Fields(c)
-		cmd := exec.Command(args[0], args[1:]...)
-		out, err := cmd.CombinedOutput()
+// Run the index'th command of the action, applying its timeout if it has one.
+// Output is captured in the result and also copied to stdout and stderr when they aren't nil.
+func (a Action) execCommand(ctx context.Context, index int, args []string, env *runEnv, stdout, stderr io.Writer) (CommandResult, error) {
+	result := CommandResult{
+		Command:  args,
+		ExitCode: -1,
+		Start:    time.Now(),
+	}
+	finish := func(err error) (CommandResult, error) {
+		result.End = time.Now()
+		result.Duration = Duration(result.End.Sub(result.Start))
 		if err != nil {
-			logger.Error("Error while running command.", err,
-				slog.String("action", a.Name),
-				slog.String("command", c),
-				slog.Any("params", params),
-			)
-			hc.Send([]byte(err.Error()))
-			// TODO: if this was an error with actually starting the command, we probably don't want to continue
-			// In that case, send it, then return
-			// return err
-		}
-		if err := hc.Send(out); err != nil {
-			logger.Error("Failed to send output for action command.", err,
-				slog.String("action", a.Name),
-				slog.String("command", c),
-				slog.String("client", hc.Address),
-			)
-			return err
+			result.Error = err.Error()
 		}
+		return result, err
+	}
+
+	if timeout := a.Commands[index].Timeout; timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout.Std())
+		defer cancel()
+	}
+
+	if len(args) == 0 {
+		return finish(fmt.Errorf("command %d of action %s is empty", index, a.Name))
+	}
+
+	outBuf := newTailBuffer(CommandOutputLimit)
+	errBuf := newTailBuffer(CommandOutputLimit)
+	cmd := env.command(args)
+	cmd.Stdout = teeWriter(outBuf, stdout)
+	cmd.Stderr = teeWriter(errBuf, stderr)
+	ooms := env.sandbox.oomKills()
+	err := runCommand(ctx, cmd)
+	result.ExitCode = cmd.ProcessState.ExitCode()
+	result.Stdout = outBuf.String()
+	result.Stderr = errBuf.String()
+	result.Truncated = outBuf.Truncated() || errBuf.Truncated()
+	if env.sandbox.oomKills() > ooms {
+		result.OOMKilled = true
+		err = fmt.Errorf("killed for running out of memory (limit %d MiB): %w", env.sandbox.memoryMB, err)
+	}
+	return finish(err)
+}
+
+func teeWriter(buf *tailBuffer, w io.Writer) io.Writer {
+	if w == nil {
+		return buf
+	}
+	return io.MultiWriter(buf, w)
+}
+
+// Describe why an action stopped early
+func stopReason(err error) string {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return "Action timed out."
+	}
+	return "Action cancelled."
+}
+
+// Check the action's resource request against the node's resource groups.
+// Each problem names the action and the group.
+func (a *Action) ResourceProblems(groups map[string]int64) []string {
+	name := a.Name
+	if name == "" {
+		name = "(unnamed)"
+	}
+	problems := []string{}
+	for _, p := range a.ResourceReq.Problems(groups) {
+		problems = append(problems, fmt.Sprintf("action %s: %s", name, p))
+	}
+	return problems
+}
+
+// Check every action's resource request, reporting all the problems at once
+func validateActionResources(actions map[string]*Action, groups map[string]int64) error {
+	names := maps.Keys(actions)
+	sort.Strings(names)
+	problems := []string{}
+	for _, name := range names {
+		problems = append(problems, actions[name].ResourceProblems(groups)...)
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid resource requests:\n  %s", strings.Join(problems, "\n  "))
 	}
-	time.Sleep(StreamTeardownDelay)
 	return nil
 }
 
@@ -5,6 +5,8 @@ import (
 	"math/rand"
 	"os"
 	"path/filepath"
+	"sort"
+	"strings"
 
 	"github.com/bofrim/gorch/node/resources"
 	"github.com/bofrim/gorch/utils"
@@ -20,17 +22,23 @@ const ActionGroupTotalDefault = 100
 const ActionGroupDefaultDefault = 0
 
 type NodeConfig struct {
-	Name             string             `yaml:"name"`
-	Port             int                `yaml:"port"`
-	Host             string             `yaml:"host"`
-	Orchestrator     string             `yaml:"orchestrator"`
-	Data             string             `yaml:"data"`
-	Log              string             `yaml:"log"`
-	LogLevel         string             `yaml:"log-level"`
-	CertPath         string             `yaml:"cert-path"`
-	ArbitraryActions bool               `yaml:"arbitrary-actions"`
-	Actions          map[string]*Action `yaml:"actions"`
-	ResourceGroups   map[string]int64   `yaml:"resource-groups"`
+	Name             string                    `yaml:"name"`
+	Labels           map[string]string         `yaml:"labels"`
+	Port             int                       `yaml:"port"`
+	Host             string                    `yaml:"host"`
+	Orchestrator     string                    `yaml:"orchestrator"`
+	Data             string                    `yaml:"data"`
+	Log              string                    `yaml:"log"`
+	LogLevel         string                    `yaml:"log-level"`
+	CertPath         string                    `yaml:"cert-path"`
+	ArbitraryActions bool                      `yaml:"arbitrary-actions"`
+	ActionTimeout    Duration                  `yaml:"default-action-timeout"`
+	QueueTimeout     Duration                  `yaml:"queue-timeout"`
+	FairShare        bool                      `yaml:"fair-share"`
+	Actions          map[string]*Action        `yaml:"actions"`
+	ResourceGroups   map[string]int64          `yaml:"resource-groups"`
+	SystemResources  resources.SystemResources `yaml:"system-resources"`
+	Sandbox          SandboxConfig             `yaml:"sandbox"`
 }
 
 func NewNodeConfig() *NodeConfig {
@@ -60,6 +68,40 @@ func (c *NodeConfig) ReadConfig(path string) error {
 		if a.Name == "" {
 			a.Name = name
 		}
+		c.Sandbox.apply(a)
+	}
+
+	// Add the groups measured from the machine; hand written groups win
+	system, err := c.SystemResources.Detect()
+	if err != nil {
+		slog.Default().Error("Error detecting system resources.", err, slog.String("path", path))
+		return err
+	}
+	if len(system) > 0 && c.ResourceGroups == nil {
+		c.ResourceGroups = map[string]int64{}
+	}
+	for name, count := range system {
+		if _, ok := c.ResourceGroups[name]; !ok {
+			c.ResourceGroups[name] = count
+		}
+	}
+
+	// Catch actions that could never get their resources before the node starts
+	problems := []string{}
+	for name, count := range c.ResourceGroups {
+		if count < 0 {
+			problems = append(problems, fmt.Sprintf("resource group %s has a negative count %d", name, count))
+		}
+	}
+	if len(problems) > 0 {
+		sort.Strings(problems)
+		err := fmt.Errorf("invalid resource groups:\n  %s", strings.Join(problems, "\n  "))
+		slog.Default().Error("Error validating node config.", err, slog.String("path", path))
+		return err
+	}
+	if err := validateActionResources(c.Actions, c.ResourceGroups); err != nil {
+		slog.Default().Error("Error validating node config.", err, slog.String("path", path))
+		return err
 	}
 	return nil
 }
@@ -107,9 +149,13 @@ func GetCliCommand() *cli.Command {
 				absDataPath, _ = filepath.Abs(config.Data)
 			}
 
+			rm := resources.NewResourceManager(config.ResourceGroups)
+			rm.FairShare = config.FairShare
+
 			// Construct the node
 			node := Node{
 				Name:             config.Name,
+				Labels:           config.Labels,
 				ServerPort:       config.Port,
 				DataDir:          absDataPath,
 				Actions:          config.Actions,
@@ -117,7 +163,12 @@ func GetCliCommand() *cli.Command {
 				ArbitraryActions: config.ArbitraryActions,
 				MaxNumActions:    int(config.ResourceGroups["total"]),
 				CertPath:         config.CertPath,
-				Resources:        resources.NewResourceManager(config.ResourceGroups),
+				Resources:        rm,
+				Jobs:             NewJobRegistry(),
+				ActionTimeout:    config.ActionTimeout.Std(),
+				QueueTimeout:     config.QueueTimeout.Std(),
+				ConfigPath:       absConfigPath,
+				Sandbox:          config.Sandbox,
 				token:            cCtx.String("token"),
 			}
 
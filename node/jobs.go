@@ -0,0 +1,277 @@
+package node
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/bofrim/gorch/hook"
+	"github.com/bofrim/gorch/node/resources"
+)
+
+// Number of finished jobs to remember before the oldest ones are dropped
+const JobHistoryLimit = 100
+
+// Number of output updates buffered per job before the oldest ones are dropped
+const JobOutputLimit = 10000
+
+var ErrJobNotFound = errors.New("job not found")
+
+type JobStatus string
+
+const (
+	JobQueued    JobStatus = "queued"
+	JobRunning   JobStatus = "running"
+	JobSucceeded JobStatus = "succeeded"
+	JobFailed    JobStatus = "failed"
+	JobCancelled JobStatus = "cancelled"
+	JobTimedOut  JobStatus = "timed_out"
+	// Gave up waiting in the queue before it ever ran
+	JobExpired JobStatus = "expired"
+)
+
+type Job struct {
+	ID         string                    `json:"id"`
+	Action     string                    `json:"action"`
+	Params     map[string]string         `json:"params"`
+	Status     JobStatus                 `json:"status"`
+	Submitted  time.Time                 `json:"submitted"`
+	Start      time.Time                 `json:"start"`
+	End        *time.Time                `json:"end,omitempty"`
+	ExitCodes  []int                     `json:"exit_codes"`
+	Results    []CommandResult           `json:"results"`
+	Error      string                    `json:"error,omitempty"`
+	StreamDest string                    `json:"stream_dest,omitempty"`
+	Resources  *resources.ResourceHandle `json:"resources"`
+	// Place in line for resources while queued, starting at 1
+	QueuePosition int `json:"queue_position,omitempty"`
+	cancel        context.CancelFunc
+	cancelled     bool
+	output        []hook.Update
+	seq           int
+	changed       chan struct{}
+}
+
+func (j *Job) IsDone() bool {
+	return j.Status != JobRunning && j.Status != JobQueued
+}
+
+// Wake up anything waiting on the job's output. Must be called with the registry lock held.
+func (j *Job) notify() {
+	close(j.changed)
+	j.changed = make(chan struct{})
+}
+
+// Copy the job so it can be handed out without holding the registry lock
+func (j *Job) snapshot() Job {
+	out := *j
+	out.ExitCodes = append([]int{}, j.ExitCodes...)
+	out.Results = append([]CommandResult{}, j.Results...)
+	out.output = nil
+	if j.End != nil {
+		end := *j.End
+		out.End = &end
+	}
+	return out
+}
+
+type JobRegistry struct {
+	mu   sync.RWMutex
+	jobs map[string]*Job
+}
+
+func NewJobRegistry() *JobRegistry {
+	return &JobRegistry{
+		jobs: map[string]*Job{},
+	}
+}
+
+func (r *JobRegistry) Create(id string, action string, params map[string]string, streamDest string, handle *resources.ResourceHandle, cancel context.CancelFunc) Job {
+	return r.add(id, action, params, streamDest, handle, cancel, JobRunning)
+}
+
+// Create a job that is waiting for resources. Start it with Started once it has them.
+func (r *JobRegistry) Enqueue(id string, action string, params map[string]string, streamDest string, cancel context.CancelFunc) Job {
+	return r.add(id, action, params, streamDest, nil, cancel, JobQueued)
+}
+
+func (r *JobRegistry) add(id string, action string, params map[string]string, streamDest string, handle *resources.ResourceHandle, cancel context.CancelFunc, status JobStatus) Job {
+	now := time.Now()
+	job := &Job{
+		ID:         id,
+		Action:     action,
+		Params:     params,
+		Status:     status,
+		Submitted:  now,
+		ExitCodes:  []int{},
+		Results:    []CommandResult{},
+		StreamDest: streamDest,
+		Resources:  handle,
+		cancel:     cancel,
+		changed:    make(chan struct{}),
+	}
+	if status == JobRunning {
+		job.Start = now
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.jobs[job.ID] = job
+	return job.snapshot()
+}
+
+// Note a queued job's new place in line
+func (r *JobRegistry) SetQueuePosition(id string, position int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	job, ok := r.jobs[id]
+	if !ok || job.Status != JobQueued {
+		return
+	}
+	job.QueuePosition = position
+	job.notify()
+}
+
+// Mark a queued job as running now that it holds its resources
+func (r *JobRegistry) Started(id string, handle *resources.ResourceHandle) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	job, ok := r.jobs[id]
+	if !ok {
+		return
+	}
+	job.Status = JobRunning
+	job.Start = time.Now()
+	job.Resources = handle
+	job.QueuePosition = 0
+	job.notify()
+}
+
+func (r *JobRegistry) Finish(id string, status JobStatus, results []CommandResult, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	job, ok := r.jobs[id]
+	if !ok {
+		return
+	}
+	end := time.Now()
+	job.End = &end
+	job.Status = status
+	job.QueuePosition = 0
+	if job.cancelled {
+		job.Status = JobCancelled
+	}
+	job.Results = append(job.Results, results...)
+	job.ExitCodes = exitCodes(job.Results)
+	if err != nil {
+		job.Error = err.Error()
+	}
+	job.notify()
+	r.prune()
+}
+
+// Cancel a running or queued job. The job is marked as cancelled once its action stops.
+func (r *JobRegistry) Cancel(id string) (Job, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	job, ok := r.jobs[id]
+	if !ok {
+		return Job{}, ErrJobNotFound
+	}
+	if job.IsDone() {
+		return job.snapshot(), fmt.Errorf("job %s already %s", id, job.Status)
+	}
+	job.cancelled = true
+	if job.cancel != nil {
+		job.cancel()
+	}
+	return job.snapshot(), nil
+}
+
+// Get an OutputFunc that records the output of a job so it can be streamed later
+func (r *JobRegistry) Recorder(id string) OutputFunc {
+	return func(stream string, command int, data []byte) {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		job, ok := r.jobs[id]
+		if !ok {
+			return
+		}
+		job.seq++
+		job.output = append(job.output, hook.Update{
+			Stream:  stream,
+			Command: command,
+			Seq:     job.seq,
+			Data:    string(data),
+		})
+		if len(job.output) > JobOutputLimit {
+			job.output = job.output[len(job.output)-JobOutputLimit:]
+		}
+		job.notify()
+	}
+}
+
+// Get the output of a job after the given sequence number along with the job itself.
+// The returned channel is closed when there is more output or the job finishes.
+func (r *JobRegistry) Output(id string, after int) ([]hook.Update, Job, <-chan struct{}, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	job, ok := r.jobs[id]
+	if !ok {
+		return nil, Job{}, nil, false
+	}
+	updates := []hook.Update{}
+	for _, u := range job.output {
+		if u.Seq > after {
+			updates = append(updates, u)
+		}
+	}
+	return updates, job.snapshot(), job.changed, true
+}
+
+func (r *JobRegistry) Get(id string) (Job, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	job, ok := r.jobs[id]
+	if !ok {
+		return Job{}, false
+	}
+	return job.snapshot(), true
+}
+
+// List all known jobs, oldest first
+func (r *JobRegistry) List() []Job {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	jobs := make([]Job, 0, len(r.jobs))
+	for _, job := range r.jobs {
+		jobs = append(jobs, job.snapshot())
+	}
+	sort.Slice(jobs, func(i, j int) bool {
+		return jobs[i].Submitted.Before(jobs[j].Submitted)
+	})
+	return jobs
+}
+
+// Drop the oldest finished jobs once there are more than JobHistoryLimit of them.
+// Must be called with the lock held.
+func (r *JobRegistry) prune() {
+	finished := []*Job{}
+	for _, job := range r.jobs {
+		if job.IsDone() {
+			finished = append(finished, job)
+		}
+	}
+	if len(finished) <= JobHistoryLimit {
+		return
+	}
+	sort.Slice(finished, func(i, j int) bool {
+		return finished[i].End.Before(*finished[j].End)
+	})
+	for _, job := range finished[:len(finished)-JobHistoryLimit] {
+		delete(r.jobs, job.ID)
+	}
+}
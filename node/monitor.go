@@ -20,7 +20,7 @@ func MonitorThread(node *Node, ctx context.Context, logger *slog.Logger, done fu
 	defer watcher.Close()
 
 	// Start watching
-	go dataMonitor(*watcher, node, ctx, logger, done)
+	go dataMonitor(watcher, node, ctx, logger, done)
 
 	// Add the directory to be watched
 	err = watcher.Add(node.DataDir)
@@ -33,7 +33,7 @@ func MonitorThread(node *Node, ctx context.Context, logger *slog.Logger, done fu
 	<-ctx.Done()
 }
 
-func dataMonitor(watcher fsnotify.Watcher, node *Node, ctx context.Context, logger *slog.Logger, done func()) {
+func dataMonitor(watcher *fsnotify.Watcher, node *Node, ctx context.Context, logger *slog.Logger, done func()) {
 	for {
 		select {
 		case event, ok := <-watcher.Events:
@@ -2,17 +2,24 @@ package node
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
-	"strings"
+	"os"
+	"os/signal"
 	"sync"
+	"syscall"
+	"time"
 
+	"github.com/bofrim/gorch/hook"
 	"github.com/bofrim/gorch/node/resources"
+	"github.com/google/uuid"
 	"golang.org/x/exp/slog"
 )
 
 type Node struct {
 	Name             string
+	Labels           map[string]string
 	ServerPort       int
 	DataDir          string
 	Data             map[string]map[string]interface{}
@@ -25,7 +32,16 @@ type Node struct {
 	MaxNumActions    int
 	CertPath         string
 	Resources        *resources.ResourceManager
-	token            string
+	Jobs             *JobRegistry
+	ActionTimeout    time.Duration
+	// How long an action may wait for resources. Actions are turned away right away when 0.
+	QueueTimeout time.Duration
+	// How sandboxed actions are set up
+	Sandbox SandboxConfig
+	// Config file the node was started from, read again to reload the resource groups
+	ConfigPath string
+	token      string
+	resizeMu   sync.Mutex
 }
 
 func (node *Node) Run(logger *slog.Logger) (err error) {
@@ -57,6 +73,8 @@ func (node *Node) Run(logger *slog.Logger) (err error) {
 		cancel()
 	}
 
+	go node.reloadOnHangup(ctx, logger)
+
 	wg.Add(1)
 	go MonitorThread(node, ctx, logger, done)
 	wg.Add(1)
@@ -80,36 +98,243 @@ func (node *Node) ReloadActions(path string) error {
 		log.Fatal(err)
 		return err
 	}
+	if err := validateActionResources(actions, node.Resources.Counts()); err != nil {
+		return err
+	}
+	for _, a := range actions {
+		node.Sandbox.apply(a)
+	}
 	node.Actions = actions
 	node.ActionsPath = path
 	return nil
 }
 
-func (node *Node) RunAction(action *Action, streamDest string, params map[string]string, logger *slog.Logger) (out string, semOk bool, err error) {
-	// First try to acquire the semaphore
-	hid, err := node.Resources.TryAcquireRequest(&action.ResourceReq)
+// Replace the resource groups while the node runs. Refused when an action could no
+// longer get its resources.
+func (node *Node) ResizeResources(groups map[string]int64, logger *slog.Logger) error {
+	node.resizeMu.Lock()
+	defer node.resizeMu.Unlock()
+	return node.resizeResources(groups, logger)
+}
+
+// Change one resource group, leaving the others alone. A count of nil removes the group.
+func (node *Node) ResizeResourceGroup(name string, count *int64, logger *slog.Logger) error {
+	node.resizeMu.Lock()
+	defer node.resizeMu.Unlock()
+	groups := node.Resources.Counts()
+	if count == nil {
+		delete(groups, name)
+	} else {
+		groups[name] = *count
+	}
+	return node.resizeResources(groups, logger)
+}
+
+// Must be called with resizeMu held
+func (node *Node) resizeResources(groups map[string]int64, logger *slog.Logger) error {
+	for name, count := range groups {
+		if count < 0 {
+			return fmt.Errorf("resource group %s has a negative count %d", name, count)
+		}
+	}
+	if err := validateActionResources(node.Actions, groups); err != nil {
+		return err
+	}
+	node.Resources.Resize(groups)
+	logger.Info("Resized resource groups.", slog.Any("groups", groups))
+	return nil
+}
+
+// Read the resource groups from the config file again and apply them
+func (node *Node) ReloadConfig(logger *slog.Logger) error {
+	if node.ConfigPath == "" {
+		return fmt.Errorf("the node wasn't started from a config file")
+	}
+	config := NewNodeConfig()
+	if err := config.ReadConfig(node.ConfigPath); err != nil {
+		return err
+	}
+	return node.ResizeResources(config.ResourceGroups, logger)
+}
+
+// Reload the config whenever the node is sent SIGHUP
+func (node *Node) reloadOnHangup(ctx context.Context, logger *slog.Logger) {
+	sigc := make(chan os.Signal, 1)
+	signal.Notify(sigc, syscall.SIGHUP)
+	defer signal.Stop(sigc)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-sigc:
+			logger.Info("Reloading config.", slog.String("path", node.ConfigPath))
+			if err := node.ReloadConfig(logger); err != nil {
+				logger.Error("Failed to reload config.", err)
+			}
+		}
+	}
+}
+
+// How an action run should be carried out
+type RunOptions struct {
+	// Address of a hook listener to stream output to
+	StreamDest string
+	// Run in the background and return as soon as the job starts
+	Async bool
+	// Lowers the action's priority when waiting for resources; higher values are ignored
+	Priority *int
+	// Who asked for the run, for sharing resources fairly
+	Caller string
+}
+
+// Start a job for the action. Unless it is streamed, async, or has to wait for resources,
+// the action is run to completion and the finished job is returned.
+func (node *Node) RunAction(action *Action, params map[string]string, opts RunOptions, logger *slog.Logger) (job Job, semOk bool, err error) {
+	claim := resources.Claim{
+		Priority: action.Priority,
+		Caller:   opts.Caller,
+		Job:      uuid.NewString(),
+	}
+	// Requests can lower their priority, but only the node's config can raise it
+	if opts.Priority != nil && *opts.Priority < claim.Priority {
+		claim.Priority = *opts.Priority
+	}
+
+	// First try to acquire the resources right away
+	hid, err := node.Resources.TryAcquireRequest(&action.ResourceReq, claim)
+	if errors.Is(err, resources.ErrUnavailable) {
+		if node.QueueTimeout > 0 {
+			return node.queueAction(action, params, opts, claim, logger), true, nil
+		}
+		return job, false, err
+	}
 	if err != nil {
-		return out, false, err
+		return job, true, err
+	}
+
+	// Track the run so that it can be looked up later
+	handle, _ := node.Resources.GetHandle(hid)
+	ctx, cancel := node.actionContext(context.Background(), action)
+	job = node.Jobs.Create(claim.Job, action.Name, params, opts.StreamDest, handle, cancel)
+	logger.Info("Starting job.", slog.String("job", job.ID), slog.String("action", action.Name))
+
+	// Next run the action
+	if opts.StreamDest != "" || opts.Async {
+		go node.runJob(ctx, cancel, action, job.ID, hid, params, opts, nil, logger)
 	} else {
-		// Next run the action
-		// Ensure the semaphore is always released!
-		if streamDest == "" {
-			// Defer so that it gets released after the action runs
-			defer node.Resources.ReleaseHandle(hid)
-			outputs, err := action.Run(params)
-			if err != nil {
-				return out, true, err
+		node.runJob(ctx, cancel, action, job.ID, hid, params, opts, nil, logger)
+		job, _ = node.Jobs.Get(job.ID)
+	}
+
+	return job, true, nil
+}
+
+// Queue a job for the action and run it once its resources free up
+func (node *Node) queueAction(action *Action, params map[string]string, opts RunOptions, claim resources.Claim, logger *slog.Logger) Job {
+	base, cancel := context.WithCancel(context.Background())
+	job := node.Jobs.Enqueue(claim.Job, action.Name, params, opts.StreamDest, cancel)
+	record := node.Jobs.Recorder(job.ID)
+	logger.Info("Queueing job.",
+		slog.String("job", job.ID),
+		slog.String("action", action.Name),
+		slog.Int("priority", claim.Priority),
+		slog.String("caller", claim.Caller),
+	)
+
+	// Hold the response until the job has its place in line
+	var once sync.Once
+	placed := make(chan struct{})
+	setPlaced := func() { once.Do(func() { close(placed) }) }
+
+	go func() {
+		defer cancel()
+		// Stream while the job waits too, so the listener knows to wait for it and sees why nothing is happening yet
+		var hc *hook.HookClient
+		if opts.StreamDest != "" {
+			hc = hook.NewHookClient(opts.StreamDest, job.ID)
+			hc.Start()
+			jobRecord := record
+			record = func(stream string, command int, data []byte) {
+				jobRecord(stream, command, data)
+				hc.Send(stream, command, data)
+			}
+		}
+		record(hook.StreamStatus, 0, []byte(fmt.Sprintf("Waiting up to %s for resources.", node.QueueTimeout)))
+		queueCtx, queueCancel := context.WithTimeout(base, node.QueueTimeout)
+		defer queueCancel()
+		hid, err := node.Resources.AcquireRequest(queueCtx, &action.ResourceReq, claim, func(position int) {
+			node.Jobs.SetQueuePosition(job.ID, position)
+			setPlaced()
+		})
+		setPlaced()
+		if err != nil {
+			status := finalStatus(err)
+			if errors.Is(err, context.DeadlineExceeded) {
+				status = JobExpired
+				err = fmt.Errorf("queue timeout expired after waiting %s for resources: %w", node.QueueTimeout, err)
 			}
-			out = strings.Join(outputs, "\n")
-		} else {
-			go func() {
-				// Release when the go routine finishes after action streaming
-				defer node.Resources.ReleaseHandle(hid)
-				action.RunStreamed(streamDest, params, logger)
-			}()
-			out = fmt.Sprintf("Streaming action output to %s", streamDest)
+			record(hook.StreamStatus, 0, []byte(err.Error()))
+			logger.Info("Queued job did not start.", slog.String("job", job.ID), slog.String("error", err.Error()))
+			node.Jobs.Finish(job.ID, status, nil, err)
+			if hc != nil {
+				hc.Stop()
+			}
+			return
+		}
+
+		handle, _ := node.Resources.GetHandle(hid)
+		node.Jobs.Started(job.ID, handle)
+		record(hook.StreamStatus, 0, []byte(fmt.Sprintf("Got resources after %s.", time.Since(job.Submitted).Round(time.Millisecond))))
+		logger.Info("Starting queued job.", slog.String("job", job.ID), slog.String("action", action.Name))
+		ctx, runCancel := node.actionContext(base, action)
+		node.runJob(ctx, runCancel, action, job.ID, hid, params, opts, hc, logger)
+	}()
+
+	<-placed
+	job, _ = node.Jobs.Get(job.ID)
+	return job
+}
+
+// Run a job that holds its resources, releasing them when it is done.
+// Jobs that stream their output use hc, or a new hook client when it is nil.
+func (node *Node) runJob(ctx context.Context, cancel context.CancelFunc, action *Action, jobId string, hid uuid.UUID, params map[string]string, opts RunOptions, hc *hook.HookClient, logger *slog.Logger) {
+	// Ensure the resources are always released!
+	defer node.Resources.ReleaseHandle(hid)
+	defer cancel()
+
+	record := node.Jobs.Recorder(jobId)
+	var results []CommandResult
+	var err error
+	if opts.StreamDest != "" {
+		if hc == nil {
+			hc = hook.NewHookClient(opts.StreamDest, jobId)
+			hc.Start()
 		}
+		results, err = action.RunStreamed(ctx, hc, params, record, logger)
+	} else {
+		results, err = action.Run(ctx, params, record)
 	}
+	node.Jobs.Finish(jobId, finalStatus(err), results, err)
+}
 
-	return out, true, err
+// Build the context an action runs under. The action's own timeout wins over the node's default.
+func (node *Node) actionContext(parent context.Context, action *Action) (context.Context, context.CancelFunc) {
+	timeout := action.Timeout.Std()
+	if timeout == 0 {
+		timeout = node.ActionTimeout
+	}
+	if timeout > 0 {
+		return context.WithTimeout(parent, timeout)
+	}
+	return context.WithCancel(parent)
+}
+
+func finalStatus(err error) JobStatus {
+	if err == nil {
+		return JobSucceeded
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return JobTimedOut
+	}
+	return JobFailed
 }
@@ -1,19 +1,31 @@
 package node
 
 import (
+	"bufio"
 	"context"
+	"crypto/sha256"
 	"crypto/tls"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
+	"sort"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/bofrim/gorch/auth"
+	"github.com/bofrim/gorch/hook"
 	"github.com/gofiber/fiber/v2"
 	"golang.org/x/exp/slog"
 )
 
+// Response header carrying the id of the job started by an action request
+const JobIdHeader = hook.JobHeader
+
 func NServerThread(node *Node, ctx context.Context, logger *slog.Logger, done func()) {
 	defer done()
 
@@ -38,7 +50,47 @@ func NServerThread(node *Node, ctx context.Context, logger *slog.Logger, done fu
 
 	app.Get("/usage", func(c *fiber.Ctx) error {
 		logger.Debug("Usage report")
-		return c.JSON(node.Resources)
+		return c.JSON(node.Resources.Snapshot())
+	})
+
+	// Endpoint for changing the resource groups while the node runs
+	resourcesEp := app.Group("/resources")
+	resourcesEp.Get("/", func(c *fiber.Ctx) error {
+		return c.JSON(node.Resources.Counts())
+	})
+	resourcesEp.Put("/", func(c *fiber.Ctx) error {
+		groups := map[string]int64{}
+		if err := json.Unmarshal(c.Body(), &groups); err != nil {
+			return c.Status(fiber.StatusBadRequest).SendString(err.Error())
+		}
+		if err := node.ResizeResources(groups, logger); err != nil {
+			return c.Status(fiber.StatusConflict).SendString(err.Error())
+		}
+		return c.JSON(node.Resources.Snapshot().Groups)
+	})
+	resourcesEp.Post("/reload", func(c *fiber.Ctx) error {
+		if err := node.ReloadConfig(logger); err != nil {
+			return c.Status(fiber.StatusConflict).SendString(err.Error())
+		}
+		return c.JSON(node.Resources.Snapshot().Groups)
+	})
+	resourcesEp.Put("/:group", func(c *fiber.Ctx) error {
+		var body struct {
+			Count *int64 `json:"count"`
+		}
+		if err := json.Unmarshal(c.Body(), &body); err != nil || body.Count == nil {
+			return c.Status(fiber.StatusBadRequest).SendString(`expected a body like {"count": 4}`)
+		}
+		if err := node.ResizeResourceGroup(strings.Clone(c.Params("group")), body.Count, logger); err != nil {
+			return c.Status(fiber.StatusConflict).SendString(err.Error())
+		}
+		return c.JSON(node.Resources.Snapshot().Groups)
+	})
+	resourcesEp.Delete("/:group", func(c *fiber.Ctx) error {
+		if err := node.ResizeResourceGroup(c.Params("group"), nil, logger); err != nil {
+			return c.Status(fiber.StatusConflict).SendString(err.Error())
+		}
+		return c.JSON(node.Resources.Snapshot().Groups)
 	})
 
 	// Endpoint for interacting with the node's data
@@ -98,13 +150,6 @@ func NServerThread(node *Node, ctx context.Context, logger *slog.Logger, done fu
 			return c.Status(http.StatusForbidden).SendString("Remote actions are disabled.")
 		}
 
-		// Parse the info from the request
-		body, sDest, err := parseActionBody(c)
-		if err != nil {
-			logger.Error("Failed to parse body for adhoc", err)
-			return c.Status(http.StatusBadRequest).Send([]byte(err.Error()))
-		}
-
 		// Expect an action definition to be specified in the body
 		var adhocAction AdHocAction
 		if err := json.Unmarshal(c.Body(), &adhocAction); err != nil {
@@ -112,9 +157,25 @@ func NServerThread(node *Node, ctx context.Context, logger *slog.Logger, done fu
 			return c.Status(http.StatusBadRequest).Send([]byte(err.Error()))
 		}
 		action := adhocAction.ActionDef
+		node.Sandbox.applyAdHoc(&action)
+		// Ad-hoc actions are written by the caller, so they can't jump ahead of configured ones
+		if action.Priority > 0 {
+			action.Priority = 0
+		}
+		if problems := action.ResourceProblems(node.Resources.Counts()); len(problems) > 0 {
+			logger.Debug("Rejecting adhoc action.", slog.Any("problems", problems))
+			return c.Status(http.StatusBadRequest).SendString(strings.Join(problems, "\n"))
+		}
+
+		// Parse the info from the request
+		body, opts, err := parseActionBody(node, c, &action)
+		if err != nil {
+			logger.Debug("Failed to parse body for adhoc", slog.String("error", err.Error()))
+			return c.Status(http.StatusBadRequest).Send([]byte(err.Error()))
+		}
 
 		// Run the action
-		out, ok, err := node.RunAction(&action, sDest, body, logger)
+		job, ok, err := node.RunAction(&action, body, opts, logger)
 		if !ok {
 			return c.Status(fiber.StatusServiceUnavailable).SendString(
 				fmt.Sprintf("%d actions already running", node.MaxNumActions),
@@ -123,19 +184,16 @@ func NServerThread(node *Node, ctx context.Context, logger *slog.Logger, done fu
 		if err != nil {
 			return c.Status(fiber.StatusBadRequest).SendString(err.Error())
 		}
-		return c.SendString(out)
+		c.Set(JobIdHeader, job.ID)
+		if job.Status == JobQueued {
+			c.Status(fiber.StatusAccepted)
+		}
+		return c.JSON(job)
 	})
 
 	actionEp.Post("/:name", func(c *fiber.Ctx) error {
 		logger.Debug("Run action", slog.String("action", c.Params("name")))
 
-		// Parse info from request
-		body, sDest, err := parseActionBody(c)
-		if err != nil {
-			logger.Error("Failed to parse body", err)
-			return c.Status(http.StatusBadRequest).Send([]byte(err.Error()))
-		}
-
 		// Find the action
 		name := c.Params("name")
 		action, ok := node.Actions[name]
@@ -145,8 +203,15 @@ func NServerThread(node *Node, ctx context.Context, logger *slog.Logger, done fu
 			return err
 		}
 
+		// Parse info from request
+		body, opts, err := parseActionBody(node, c, action)
+		if err != nil {
+			logger.Debug("Failed to parse body", slog.String("error", err.Error()))
+			return c.Status(http.StatusBadRequest).Send([]byte(err.Error()))
+		}
+
 		// Run the action
-		out, ok, err := node.RunAction(action, sDest, body, logger)
+		job, ok, err := node.RunAction(action, body, opts, logger)
 		if !ok {
 			return c.Status(fiber.StatusServiceUnavailable).SendString(
 				fmt.Sprintf("%d actions already running", node.MaxNumActions),
@@ -155,7 +220,64 @@ func NServerThread(node *Node, ctx context.Context, logger *slog.Logger, done fu
 		if err != nil {
 			return c.Status(fiber.StatusBadRequest).SendString(err.Error())
 		}
-		return c.SendString(out)
+		c.Set(JobIdHeader, job.ID)
+		if job.Status == JobQueued {
+			c.Status(fiber.StatusAccepted)
+		}
+		return c.JSON(job)
+	})
+
+	// Endpoint for inspecting jobs started on the node
+	jobsEp := app.Group("/jobs")
+	jobsEp.Get("/", func(c *fiber.Ctx) error {
+		logger.Debug("List jobs")
+		return c.JSON(node.Jobs.List())
+	})
+	jobsEp.Get("/:id", func(c *fiber.Ctx) error {
+		logger.Debug("Get job", slog.String("job", c.Params("id")))
+		job, ok := node.Jobs.Get(c.Params("id"))
+		if !ok {
+			return c.Status(fiber.StatusNotFound).SendString(
+				fmt.Sprintf("Job %s not found.", c.Params("id")),
+			)
+		}
+		return c.JSON(job)
+	})
+	jobsEp.Get("/:id/stream", func(c *fiber.Ctx) error {
+		// Copied since the stream outlives the request's buffers
+		id := strings.Clone(c.Params("id"))
+		logger.Debug("Stream job", slog.String("job", id))
+		if _, ok := node.Jobs.Get(id); !ok {
+			return c.Status(fiber.StatusNotFound).SendString(
+				fmt.Sprintf("Job %s not found.", id),
+			)
+		}
+
+		// Allow clients to pick up where they left off
+		after, _ := strconv.Atoi(c.Query("after", "0"))
+		if lastId, err := strconv.Atoi(c.Get("Last-Event-ID")); err == nil {
+			after = lastId
+		}
+
+		c.Set("Content-Type", "text/event-stream")
+		c.Set("Cache-Control", "no-cache")
+		c.Context().SetBodyStreamWriter(func(w *bufio.Writer) {
+			streamJob(node, id, after, w)
+		})
+		return nil
+	})
+	jobsEp.Delete("/:id", func(c *fiber.Ctx) error {
+		logger.Info("Cancel job", slog.String("job", c.Params("id")))
+		job, err := node.Jobs.Cancel(c.Params("id"))
+		if errors.Is(err, ErrJobNotFound) {
+			return c.Status(fiber.StatusNotFound).SendString(
+				fmt.Sprintf("Job %s not found.", c.Params("id")),
+			)
+		}
+		if err != nil {
+			return c.Status(fiber.StatusConflict).SendString(err.Error())
+		}
+		return c.JSON(job)
 	})
 
 	// Run the App
@@ -192,33 +314,138 @@ func NServerThread(node *Node, ctx context.Context, logger *slog.Logger, done fu
 	app.Listen(fmt.Sprintf(":%d", node.ServerPort))
 }
 
-func parseActionBody(c *fiber.Ctx) (body map[string]string, sDest string, err error) {
+// How often a comment is sent on an idle job stream to detect dropped clients
+const JobStreamKeepAlivePeriod = 15 * time.Second
+
+// Write the output of a job as server-sent events until the job finishes or the client goes away
+func streamJob(node *Node, id string, after int, w *bufio.Writer) {
+	keepAlive := time.NewTicker(JobStreamKeepAlivePeriod)
+	defer keepAlive.Stop()
+	for {
+		updates, job, changed, ok := node.Jobs.Output(id, after)
+		if !ok {
+			return
+		}
+		for _, u := range updates {
+			if err := hook.WriteEvent(w, hook.EventUpdate, u.Seq, u); err != nil {
+				return
+			}
+			after = u.Seq
+		}
+		if job.IsDone() {
+			hook.WriteEvent(w, hook.EventDone, after, job)
+			w.Flush()
+			return
+		}
+		if err := w.Flush(); err != nil {
+			return
+		}
+
+		select {
+		case <-changed:
+		case <-keepAlive.C:
+			if _, err := w.WriteString(": keepalive\n\n"); err != nil {
+				return
+			}
+			if err := w.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// Read the params and run options from the body of an action request, checking
+// the params against the action's schema
+func parseActionBody(node *Node, c *fiber.Ctx, action *Action) (body map[string]string, opts RunOptions, err error) {
 	body = map[string]string{}
-	if c.Body() != nil {
+	if len(c.Body()) > 0 {
 		var m map[string]interface{}
 		err := json.Unmarshal(c.Body(), &m)
 		if err != nil {
-			return nil, sDest, err
+			return nil, opts, err
 		}
+		problems := ParamErrors{}
 		for k, v := range m {
 			// Skip the "action"; it will be dealt with elsewhere
-			if k != "action" {
-				body[k] = v.(string)
+			if k == "action" || v == nil {
+				continue
 			}
+			s, convertErr := paramString(v)
+			if convertErr != nil {
+				problems = append(problems, fmt.Sprintf("%s %s", k, convertErr))
+				continue
+			}
+			body[k] = s
+		}
+		if len(problems) > 0 {
+			sort.Strings(problems)
+			return nil, opts, problems
 		}
 	}
+	if body, err = action.Params.Validate(body); err != nil {
+		return nil, opts, err
+	}
 	if body["stream_addr"] != "" && body["stream_port"] != "" {
 		sAddr := body["stream_addr"]
 		if sAddr == "loopback" {
-			sAddr = c.IP()
+			sAddr = node.clientIP(c)
 		}
 		sPortStr := body["stream_port"]
 		sPort, convertErr := strconv.Atoi(sPortStr)
 		if convertErr != nil {
-			return nil, "", fmt.Errorf("invalid stream port: %s\nbody: %+v", sPortStr, body)
+			return nil, opts, fmt.Errorf("invalid stream port: %s\nbody: %+v", sPortStr, body)
 		}
-		sDest = fmt.Sprintf("%s:%d", sAddr, sPort)
+		opts.StreamDest = fmt.Sprintf("%s:%d", sAddr, sPort)
+	}
+	opts.Async = body["async"] == "true"
+	if p, ok := body["priority"]; ok {
+		priority, convertErr := strconv.Atoi(p)
+		if convertErr != nil {
+			return nil, opts, fmt.Errorf("invalid priority: %s", p)
+		}
+		opts.Priority = &priority
+	}
+	opts.Caller = node.callerId(c)
+
+	return body, opts, err
+}
+
+// Identify who sent a request without keeping their token around
+func (node *Node) callerId(c *fiber.Ctx) string {
+	if token := strings.TrimPrefix(c.Get("X-Authorization"), "Bearer "); token != "" {
+		sum := sha256.Sum256([]byte(token))
+		return "token:" + hex.EncodeToString(sum[:6])
+	}
+	return "ip:" + node.clientIP(c)
+}
+
+// The address of the user behind a request, looking through the orchestrator if it was proxied.
+// Anyone else could claim to be forwarding for whoever they like, so only the orchestrator is believed.
+func (node *Node) clientIP(c *fiber.Ctx) string {
+	if forwarded := c.Get("X-Forwarded-For"); forwarded != "" && node.fromOrchestrator(c.IP()) {
+		return strings.TrimSpace(strings.Split(forwarded, ",")[0])
 	}
+	return c.IP()
+}
 
-	return body, sDest, err
+// Whether a peer address is the orchestrator this node registers with
+func (node *Node) fromOrchestrator(ip string) bool {
+	if node.OrchAddr == "" {
+		return false
+	}
+	host, _, err := net.SplitHostPort(node.OrchAddr)
+	if err != nil {
+		host = node.OrchAddr
+	}
+	addrs, err := net.LookupHost(host)
+	if err != nil {
+		return false
+	}
+	peer := net.ParseIP(ip)
+	for _, addr := range addrs {
+		if net.ParseIP(addr).Equal(peer) {
+			return true
+		}
+	}
+	return false
 }
@@ -0,0 +1,66 @@
+package node
+
+import (
+	"io"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+func TestClientIPOnlyTrustsTheOrchestrator(t *testing.T) {
+	tests := []struct {
+		orchestrator string
+		forwarded    string
+		want         string
+	}{
+		{"", "", "0.0.0.0"},
+		{"", "10.1.1.1", "0.0.0.0"},
+		{"10.9.9.9:8443", "10.1.1.1", "0.0.0.0"},
+		{"0.0.0.0:8443", "", "0.0.0.0"},
+		{"0.0.0.0:8443", "10.1.1.1", "10.1.1.1"},
+		{"0.0.0.0:8443", "10.1.1.1, 10.2.2.2", "10.1.1.1"},
+	}
+	for _, test := range tests {
+		// Test requests come from 0.0.0.0
+		node := &Node{OrchAddr: test.orchestrator}
+		app := fiber.New()
+		app.Get("/", func(c *fiber.Ctx) error {
+			return c.SendString(node.clientIP(c))
+		})
+		req := httptest.NewRequest("GET", "/", nil)
+		if test.forwarded != "" {
+			req.Header.Set("X-Forwarded-For", test.forwarded)
+		}
+		resp, err := app.Test(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, _ := io.ReadAll(resp.Body)
+		if string(got) != test.want {
+			t.Errorf("orchestrator %q forwarding for %q: got %s, want %s", test.orchestrator, test.forwarded, got, test.want)
+		}
+	}
+}
+
+func TestFromOrchestrator(t *testing.T) {
+	tests := []struct {
+		orchestrator string
+		peer         string
+		want         bool
+	}{
+		{"", "127.0.0.1", false},
+		{"127.0.0.1:8443", "127.0.0.1", true},
+		{"127.0.0.1:8443", "10.0.0.1", false},
+		{"127.0.0.1", "127.0.0.1", true},
+		{"[::1]:8443", "::1", true},
+		{"localhost:8443", "127.0.0.1", true},
+		{"localhost:8443", "10.0.0.1", false},
+	}
+	for _, test := range tests {
+		node := &Node{OrchAddr: test.orchestrator}
+		if got := node.fromOrchestrator(test.peer); got != test.want {
+			t.Errorf("orchestrator %q, peer %s: got %v", test.orchestrator, test.peer, got)
+		}
+	}
+}
@@ -48,7 +48,7 @@ func NodeStateThread(n *Node, ctx context.Context, logger *slog.Logger, done fun
 
 	if n.OrchAddr != "" {
 		n.nodeState.commState = Polling
-		if err := register(n.OrchAddr, n.Name, n.ServerPort); err == nil {
+		if err := register(n.OrchAddr, n.Name, n.ServerPort, n.Labels); err == nil {
 			logger.Debug("Start-up registration.", slog.String("node", n.Name))
 			n.nodeState.commState = Registered
 		}
@@ -70,7 +70,7 @@ func NodeStateThread(n *Node, ctx context.Context, logger *slog.Logger, done fun
 				}
 				fallthrough
 			case Polling:
-				if err := register(n.OrchAddr, n.Name, n.ServerPort); err == nil {
+				if err := register(n.OrchAddr, n.Name, n.ServerPort, n.Labels); err == nil {
 					n.nodeState.ChangeState(Registered)
 				}
 			case Registered:
@@ -98,12 +98,13 @@ func NodeStateThread(n *Node, ctx context.Context, logger *slog.Logger, done fun
 	}
 }
 
-func register(orchAddr, nodeName string, nodePort int) error {
+func register(orchAddr, nodeName string, nodePort int, labels map[string]string) error {
 	// Register with the orchestrator
 	url := fmt.Sprintf("https://%s/register/", orchAddr)
 	data := orchestrator.NodeRegistration{
-		NodeName: nodeName,
-		NodePort: nodePort,
+		NodeName:   nodeName,
+		NodePort:   nodePort,
+		NodeLabels: labels,
 	}
 	b, err := json.Marshal(data)
 	if err != nil {
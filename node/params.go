@@ -0,0 +1,324 @@
+package node
+
+import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// The kinds of values a param accepts
+type ParamType string
+
+const (
+	ParamString ParamType = "string"
+	ParamInt    ParamType = "int"
+	ParamBool   ParamType = "bool"
+	ParamEnum   ParamType = "enum"
+	ParamPath   ParamType = "path"
+)
+
+// A param an action takes. Params can be configured as a list of names, which
+// are required strings, or as a mapping from name to schema:
+//
+//	params:
+//	  count:
+//	    type: int
+//	    min: 1
+//	    max: 10
+//	    default: 3
+//	  mode:
+//	    type: enum
+//	    enum: ["fast", "safe"]
+//	    required: true
+//
+// Min and max bound the value of ints and the length of strings and paths.
+type Param struct {
+	Name        string      `yaml:"name" json:"name"`
+	Type        ParamType   `yaml:"type" json:"type"`
+	Required    bool        `yaml:"required" json:"required"`
+	Default     *paramValue `yaml:"default" json:"default,omitempty"`
+	Pattern     string      `yaml:"pattern" json:"pattern,omitempty"`
+	Min         *int64      `yaml:"min" json:"min,omitempty"`
+	Max         *int64      `yaml:"max" json:"max,omitempty"`
+	Enum        []string    `yaml:"enum" json:"enum,omitempty"`
+	Description string      `yaml:"description" json:"description,omitempty"`
+	// Paste the value into commands as it is instead of passing it separately.
+	// Lets the value add shell syntax or extra arguments, so give it a pattern.
+	Unsafe  bool `yaml:"unsafe" json:"unsafe,omitempty"`
+	pattern *regexp.Regexp
+}
+
+// The params of an action, in the order they were configured
+type Params []*Param
+
+// Avoid recursing into the custom unmarshallers
+type paramFields Param
+
+// A value given for a param. Numbers and bools are accepted and passed to commands as text.
+type paramValue string
+
+func (v *paramValue) UnmarshalJSON(data []byte) error {
+	var raw any
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	s, err := paramString(raw)
+	if err != nil {
+		return err
+	}
+	*v = paramValue(s)
+	return nil
+}
+
+// The text form of a value decoded from JSON
+func paramString(v any) (string, error) {
+	switch v := v.(type) {
+	case string:
+		return v, nil
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	}
+	return "", fmt.Errorf("must be a string, number or bool")
+}
+
+// Every way a request's params broke an action's schema
+type ParamErrors []string
+
+func (e ParamErrors) Error() string {
+	return fmt.Sprintf("invalid params:\n  %s", strings.Join(e, "\n  "))
+}
+
+func (p *Params) UnmarshalYAML(node *yaml.Node) error {
+	switch node.Kind {
+	case yaml.SequenceNode:
+		var names []string
+		if err := node.Decode(&names); err != nil {
+			return err
+		}
+		return p.fromNames(names)
+	case yaml.MappingNode:
+		params := Params{}
+		// Mappings keep their keys in order in the node's content
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			param := &Param{}
+			if err := node.Content[i+1].Decode((*paramFields)(param)); err != nil {
+				return err
+			}
+			param.Name = node.Content[i].Value
+			params = append(params, param)
+		}
+		return p.set(params)
+	}
+	return fmt.Errorf("params must be a list of names or a mapping of name to schema")
+}
+
+// Ad-hoc actions may give params as a list of names, a list of schemas, or a mapping of name to schema
+func (p *Params) UnmarshalJSON(data []byte) error {
+	var names []string
+	if err := json.Unmarshal(data, &names); err == nil {
+		return p.fromNames(names)
+	}
+	var list []*paramFields
+	if err := json.Unmarshal(data, &list); err == nil {
+		params := make(Params, len(list))
+		for i, param := range list {
+			params[i] = (*Param)(param)
+		}
+		return p.set(params)
+	}
+	var m map[string]*paramFields
+	if err := json.Unmarshal(data, &m); err != nil {
+		return fmt.Errorf("params must be a list of names or a mapping of name to schema")
+	}
+	names = make([]string, 0, len(m))
+	for name := range m {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	params := Params{}
+	for _, name := range names {
+		param := (*Param)(m[name])
+		param.Name = name
+		params = append(params, param)
+	}
+	return p.set(params)
+}
+
+func (p *Params) fromNames(names []string) error {
+	params := make(Params, len(names))
+	for i, name := range names {
+		params[i] = &Param{Name: name, Required: true}
+	}
+	return p.set(params)
+}
+
+// Fill in defaults and make sure the schemas make sense
+func (p *Params) set(params Params) error {
+	problems := []string{}
+	for _, param := range params {
+		if err := param.prepare(); err != nil {
+			problems = append(problems, err.Error())
+		}
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid params: %s", strings.Join(problems, "; "))
+	}
+	*p = params
+	return nil
+}
+
+func (param *Param) prepare() error {
+	if param.Name == "" {
+		return fmt.Errorf("a param has no name")
+	}
+	if param.Type == "" {
+		param.Type = ParamString
+		if len(param.Enum) > 0 {
+			param.Type = ParamEnum
+		}
+	}
+	switch param.Type {
+	case ParamString, ParamInt, ParamBool, ParamPath:
+	case ParamEnum:
+		if len(param.Enum) == 0 {
+			return fmt.Errorf("param %s is an enum without any values", param.Name)
+		}
+	default:
+		return fmt.Errorf("param %s has unknown type %s", param.Name, param.Type)
+	}
+	if param.Pattern != "" {
+		// Match the whole value, not just part of it
+		pattern, err := regexp.Compile("^(?:" + param.Pattern + ")$")
+		if err != nil {
+			return fmt.Errorf("param %s has a bad pattern: %w", param.Name, err)
+		}
+		param.pattern = pattern
+	}
+	if param.Default != nil {
+		if _, problem := param.check(string(*param.Default)); problem != "" {
+			return fmt.Errorf("param %s has a bad default: %s", param.Name, problem)
+		}
+	}
+	return nil
+}
+
+// Check a value against the param, returning it in the form it is passed to
+// commands, or what is wrong with it
+func (param *Param) check(value string) (string, string) {
+	var length int64
+	switch param.Type {
+	case ParamInt:
+		n, err := strconv.ParseInt(strings.TrimSpace(value), 10, 64)
+		if err != nil {
+			return "", fmt.Sprintf("%s must be an integer, got %q", param.Name, value)
+		}
+		if param.Min != nil && n < *param.Min {
+			return "", fmt.Sprintf("%s must be at least %d, got %d", param.Name, *param.Min, n)
+		}
+		if param.Max != nil && n > *param.Max {
+			return "", fmt.Sprintf("%s must be at most %d, got %d", param.Name, *param.Max, n)
+		}
+		value = strconv.FormatInt(n, 10)
+	case ParamBool:
+		b, err := strconv.ParseBool(strings.TrimSpace(value))
+		if err != nil {
+			return "", fmt.Sprintf("%s must be true or false, got %q", param.Name, value)
+		}
+		value = strconv.FormatBool(b)
+	case ParamEnum:
+		found := false
+		for _, option := range param.Enum {
+			if value == option {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return "", fmt.Sprintf("%s must be one of %s, got %q", param.Name, strings.Join(param.Enum, ", "), value)
+		}
+	case ParamPath:
+		if strings.ContainsRune(value, 0) {
+			return "", fmt.Sprintf("%s must not contain NUL bytes", param.Name)
+		}
+		for _, part := range strings.Split(filepath.ToSlash(value), "/") {
+			if part == ".." {
+				return "", fmt.Sprintf("%s must not contain '..', got %q", param.Name, value)
+			}
+		}
+		if value != "" {
+			value = filepath.Clean(value)
+		}
+		length = int64(len(value))
+	default:
+		length = int64(len(value))
+	}
+
+	if param.Type == ParamString || param.Type == ParamPath {
+		if param.Min != nil && length < *param.Min {
+			return "", fmt.Sprintf("%s must be at least %d characters long", param.Name, *param.Min)
+		}
+		if param.Max != nil && length > *param.Max {
+			return "", fmt.Sprintf("%s must be at most %d characters long", param.Name, *param.Max)
+		}
+	}
+	if param.pattern != nil && !param.pattern.MatchString(value) {
+		return "", fmt.Sprintf("%s must match %s, got %q", param.Name, param.Pattern, value)
+	}
+	return value, ""
+}
+
+// Names of the params that are pasted into commands as they are
+func (p Params) unsafe() map[string]bool {
+	names := map[string]bool{}
+	for _, param := range p {
+		if param.Unsafe {
+			names[param.Name] = true
+		}
+	}
+	return names
+}
+
+// Check the values given for the params, filling in defaults. Values that aren't
+// params of the action are passed through untouched. Every violation is reported at once.
+func (p Params) Validate(values map[string]string) (map[string]string, error) {
+	out := make(map[string]string, len(values))
+	for k, v := range values {
+		out[k] = v
+	}
+
+	problems := ParamErrors{}
+	for _, param := range p {
+		value, ok := values[param.Name]
+		if !ok {
+			switch {
+			case param.Default != nil:
+				value = string(*param.Default)
+			case param.Required:
+				problems = append(problems, fmt.Sprintf("%s is required", param.Name))
+				continue
+			default:
+				// Optional params without a default are left empty
+				out[param.Name] = ""
+				continue
+			}
+		}
+		checked, problem := param.check(value)
+		if problem != "" {
+			problems = append(problems, problem)
+			continue
+		}
+		out[param.Name] = checked
+	}
+	if len(problems) > 0 {
+		return nil, problems
+	}
+	return out, nil
+}
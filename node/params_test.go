@@ -0,0 +1,179 @@
+package node
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+const schemaYAML = `
+count:
+  type: int
+  min: 1
+  max: 10
+  default: 3
+mode:
+  enum: ["fast", "safe"]
+  required: true
+verbose:
+  type: bool
+name:
+  min: 2
+  max: 5
+  pattern: "[a-z]+"
+dir:
+  type: path
+`
+
+func TestParamsFromYAML(t *testing.T) {
+	var params Params
+	if err := yaml.Unmarshal([]byte(schemaYAML), &params); err != nil {
+		t.Fatal(err)
+	}
+	names := []string{}
+	for _, param := range params {
+		names = append(names, param.Name+":"+string(param.Type))
+	}
+	// Configured order is kept and types are filled in
+	want := []string{"count:int", "mode:enum", "verbose:bool", "name:string", "dir:path"}
+	if !reflect.DeepEqual(names, want) {
+		t.Errorf("got %v, want %v", names, want)
+	}
+
+	var list Params
+	if err := yaml.Unmarshal([]byte(`["a", "b"]`), &list); err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 2 || !list[0].Required || list[1].Type != ParamString {
+		t.Errorf("got %+v %+v for a list of names", list[0], list[1])
+	}
+}
+
+func TestParamsFromJSON(t *testing.T) {
+	tests := []struct {
+		params string
+		want   []string
+	}{
+		{`["a", "b"]`, []string{"a:string", "b:string"}},
+		{`[{"name": "b", "type": "int"}, {"name": "a"}]`, []string{"b:int", "a:string"}},
+		{`{"b": {"type": "bool"}, "a": {"enum": ["x"]}}`, []string{"a:enum", "b:bool"}},
+	}
+	for _, test := range tests {
+		var params Params
+		if err := json.Unmarshal([]byte(test.params), &params); err != nil {
+			t.Errorf("%s: %v", test.params, err)
+			continue
+		}
+		got := []string{}
+		for _, param := range params {
+			got = append(got, param.Name+":"+string(param.Type))
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %v, want %v", test.params, got, test.want)
+		}
+	}
+}
+
+func TestBadParamSchemas(t *testing.T) {
+	tests := []struct {
+		schema  string
+		problem string
+	}{
+		{`{"a": {"type": "float"}}`, "unknown type"},
+		{`{"a": {"type": "enum"}}`, "without any values"},
+		{`{"a": {"pattern": "("}}`, "bad pattern"},
+		{`{"a": {"type": "int", "max": 2, "default": 5}}`, "bad default"},
+		{`{"a": {"enum": ["x"], "default": "y"}}`, "bad default"},
+		{`[{"type": "int"}]`, "no name"},
+		{`"a"`, "list of names or a mapping"},
+	}
+	for _, test := range tests {
+		var params Params
+		err := json.Unmarshal([]byte(test.schema), &params)
+		if err == nil || !strings.Contains(err.Error(), test.problem) {
+			t.Errorf("%s: got %v, want %q", test.schema, err, test.problem)
+		}
+	}
+}
+
+func TestParamCheck(t *testing.T) {
+	var params Params
+	if err := yaml.Unmarshal([]byte(schemaYAML), &params); err != nil {
+		t.Fatal(err)
+	}
+	byName := map[string]*Param{}
+	for _, param := range params {
+		byName[param.Name] = param
+	}
+	tests := []struct {
+		param   string
+		value   string
+		want    string
+		problem string
+	}{
+		{"count", " 7 ", "7", ""},
+		{"count", "0", "", "at least 1"},
+		{"count", "11", "", "at most 10"},
+		{"count", "3.5", "", "must be an integer"},
+		{"mode", "safe", "safe", ""},
+		{"mode", "SAFE", "", "must be one of fast, safe"},
+		{"verbose", "1", "true", ""},
+		{"verbose", "yes", "", "true or false"},
+		{"name", "abc", "abc", ""},
+		{"name", "a", "", "at least 2 characters"},
+		{"name", "abcdef", "", "at most 5 characters"},
+		{"name", "ab1", "", "must match"},
+		{"dir", "logs//today/", "logs/today", ""},
+		{"dir", "logs/../etc", "", "'..'"},
+		{"dir", "a\x00b", "", "NUL"},
+	}
+	for _, test := range tests {
+		got, problem := byName[test.param].check(test.value)
+		if got != test.want || (test.problem == "") != (problem == "") || !strings.Contains(problem, test.problem) {
+			t.Errorf("%s=%q: got %q, %q, want %q, %q", test.param, test.value, got, problem, test.want, test.problem)
+		}
+	}
+}
+
+func TestParamsValidate(t *testing.T) {
+	var params Params
+	if err := yaml.Unmarshal([]byte(schemaYAML), &params); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		values   map[string]string
+		want     map[string]string
+		problems []string
+	}{
+		{
+			map[string]string{"mode": "fast", "async": "true"},
+			map[string]string{"count": "3", "mode": "fast", "verbose": "", "name": "", "dir": "", "async": "true"},
+			nil,
+		},
+		{
+			map[string]string{"mode": "safe", "count": "5", "verbose": "false", "name": "ab", "dir": "./x"},
+			map[string]string{"count": "5", "mode": "safe", "verbose": "false", "name": "ab", "dir": "x"},
+			nil,
+		},
+		{
+			map[string]string{"count": "99", "name": "toolong"},
+			nil,
+			[]string{"count must be at most 10, got 99", "mode is required", "name must be at most 5 characters long"},
+		},
+	}
+	for _, test := range tests {
+		got, err := params.Validate(test.values)
+		if test.problems != nil {
+			if problems, ok := err.(ParamErrors); !ok || !reflect.DeepEqual([]string(problems), test.problems) {
+				t.Errorf("%v: got %v, want %q", test.values, err, test.problems)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%v: got %v, %v, want %v", test.values, got, err, test.want)
+		}
+	}
+}
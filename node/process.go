@@ -0,0 +1,39 @@
+package node
+
+import (
+	"context"
+	"os/exec"
+	"time"
+)
+
+// How long a cancelled command gets to exit after SIGTERM before it is killed
+const KillGracePeriod = 5 * time.Second
+
+// Run a command in its own process group so that it, and anything it spawned,
+// can be signaled together once ctx is done.
+func runCommand(ctx context.Context, cmd *exec.Cmd) error {
+	newProcessGroup(cmd)
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	waitDone := make(chan error, 1)
+	go func() {
+		waitDone <- cmd.Wait()
+	}()
+
+	select {
+	case err := <-waitDone:
+		return err
+	case <-ctx.Done():
+	}
+
+	// Ask nicely first, then make sure the whole group is gone
+	stopProcessGroup(cmd, false)
+	select {
+	case <-waitDone:
+	case <-time.After(KillGracePeriod):
+		stopProcessGroup(cmd, true)
+		<-waitDone
+	}
+	return ctx.Err()
+}
@@ -0,0 +1,15 @@
+//go:build !unix
+
+package node
+
+import (
+	"os/exec"
+)
+
+// Process groups are a unix thing; only the command itself can be stopped
+func newProcessGroup(cmd *exec.Cmd) {}
+
+// There is no asking nicely, so the command is killed either way
+func stopProcessGroup(cmd *exec.Cmd, force bool) {
+	_ = cmd.Process.Kill()
+}
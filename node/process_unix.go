@@ -0,0 +1,25 @@
+//go:build unix
+
+package node
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// Start the command as the leader of a new process group
+func newProcessGroup(cmd *exec.Cmd) {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Setpgid = true
+}
+
+// Send the command's process group SIGTERM, or SIGKILL when forced
+func stopProcessGroup(cmd *exec.Cmd, force bool) {
+	sig := syscall.SIGTERM
+	if force {
+		sig = syscall.SIGKILL
+	}
+	_ = syscall.Kill(-cmd.Process.Pid, sig)
+}
@@ -1,15 +1,10 @@
 package resources
 
-import (
-	"context"
-
-	"golang.org/x/sync/semaphore"
-)
-
 type ResourceGroup struct {
 	ResourceBase
-	semaphore semaphore.Weighted
-	Held      int64 `json:"held"`
+	Held int64 `json:"held"`
+	// Taken out of the config while still held; dropped once the last holder releases it
+	Removed bool `json:"removed,omitempty"`
 }
 
 func NewResourceGroup(name string, count int64) *ResourceGroup {
@@ -18,8 +13,7 @@ func NewResourceGroup(name string, count int64) *ResourceGroup {
 			Name:  name,
 			Count: count,
 		},
-		semaphore: *semaphore.NewWeighted(count),
-		Held:      0,
+		Held: 0,
 	}
 }
 
@@ -39,16 +33,12 @@ func (r *ResourceGroup) GetHeld() int64 {
 	return r.Held
 }
 
-func (r *ResourceGroup) Acquire(ctx context.Context, n int64) error {
-	if err := r.semaphore.Acquire(ctx, n); err != nil {
-		return err
-	}
-	r.Held += n
-	return nil
+// Whether n more could be held right now
+func (r *ResourceGroup) Fits(n int64) bool {
+	return r.Held+n <= r.Count
 }
 
 func (r *ResourceGroup) Release(n int64) {
-	r.semaphore.Release(n)
 	r.Held -= n
 	if r.Held < 0 {
 		r.Held = 0
@@ -56,9 +46,9 @@ func (r *ResourceGroup) Release(n int64) {
 }
 
 func (r *ResourceGroup) TryAcquire(n int64) bool {
-	ok := r.semaphore.TryAcquire(n)
-	if ok {
-		r.Held += n
+	if !r.Fits(n) {
+		return false
 	}
-	return ok
+	r.Held += n
+	return true
 }
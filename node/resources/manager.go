@@ -3,91 +3,370 @@ package resources
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/google/uuid"
 	"gopkg.in/yaml.v3"
 )
 
+var ErrUnavailable = errors.New("unable to acquire resources")
+
 type ResourceHandle struct {
-	id      uuid.UUID
+	ID      uuid.UUID        `json:"id"`
 	Request *ResourceRequest `json:"request"`
 	Created time.Time        `json:"created"`
+	Claim
+}
+
+// Who is asking for resources and how urgently
+type Claim struct {
+	// Higher priorities are served first
+	Priority int `json:"priority"`
+	// Identifies the caller for fair sharing
+	Caller string `json:"caller,omitempty"`
+	// The job the resources are for
+	Job string `json:"job,omitempty"`
 }
 
+// Hands out resources to actions. Safe to use from many goroutines; everything
+// below is guarded by mu, and Snapshot is the way to look inside.
 type ResourceManager struct {
-	Groups map[string]*ResourceGroup     `json:"groups"`
-	Active map[uuid.UUID]*ResourceHandle `json:"active"`
+	// Within a priority, serve callers holding the fewest handles first,
+	// then whoever was served longest ago
+	FairShare bool
+	mu        sync.Mutex
+	groups    map[string]*ResourceGroup
+	active    map[uuid.UUID]*ResourceHandle
+	queue     []*waiter
+	nextSeq   uint64
+	grants    uint64
+	// When each caller last got resources, counted in grants
+	lastServed map[string]uint64
+}
+
+// A request waiting for resources to free up
+type waiter struct {
+	request *ResourceRequest
+	claim   Claim
+	seq     uint64
+	since   time.Time
+	handle  *ResourceHandle
+	ready   chan struct{}
+	// Set instead of handle when the request can no longer be granted
+	err error
+	// Told the waiter's place in the queue whenever it changes. Called with the lock held.
+	onQueued func(position int)
+	position int
 }
 
 func NewResourceManager(m map[string]int64) *ResourceManager {
 	return &ResourceManager{
-		Groups: NewResourceGroupMap(m),
-		Active: map[uuid.UUID]*ResourceHandle{},
+		groups:     NewResourceGroupMap(m),
+		active:     map[uuid.UUID]*ResourceHandle{},
+		lastServed: map[string]uint64{},
 	}
 }
 
 func (rm *ResourceManager) GetCount(name string) int64 {
-	return rm.Groups[name].GetCount()
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+	if group, ok := rm.groups[name]; ok {
+		return group.GetCount()
+	}
+	return 0
 }
 
 func (rm *ResourceManager) GetHeld(name string) int64 {
-	return rm.Groups[name].GetHeld()
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+	if group, ok := rm.groups[name]; ok {
+		return group.GetHeld()
+	}
+	return 0
+}
+
+// Take the resources if they are free right now and nobody queued at the same or a higher priority needs them
+func (rm *ResourceManager) TryAcquireRequest(request *ResourceRequest, claim Claim) (uuid.UUID, error) {
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+	if err := rm.check(request); err != nil {
+		return uuid.UUID{}, err
+	}
+	if !rm.fits(request, rm.queuedGroups(claim.Priority)) {
+		return uuid.UUID{}, ErrUnavailable
+	}
+	return rm.grant(request, claim).ID, nil
+}
+
+// Wait in line for the resources until they are free or ctx is done.
+// Every group of the request is taken at once, so two requests can never each
+// hold part of what the other is waiting for.
+func (rm *ResourceManager) AcquireRequest(ctx context.Context, request *ResourceRequest, claim Claim, onQueued func(position int)) (uuid.UUID, error) {
+	rm.mu.Lock()
+	if err := rm.check(request); err != nil {
+		rm.mu.Unlock()
+		return uuid.UUID{}, err
+	}
+	rm.nextSeq++
+	w := &waiter{
+		request:  request,
+		claim:    claim,
+		seq:      rm.nextSeq,
+		since:    time.Now(),
+		ready:    make(chan struct{}),
+		onQueued: onQueued,
+	}
+	rm.queue = append(rm.queue, w)
+	rm.dispatch()
+	rm.mu.Unlock()
+
+	select {
+	case <-w.ready:
+		if w.err != nil {
+			return uuid.UUID{}, w.err
+		}
+		return w.handle.ID, nil
+	case <-ctx.Done():
+	}
+
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+	select {
+	case <-w.ready:
+		// Granted just as we gave up; hand it back
+		if w.err == nil {
+			rm.release(w.handle)
+		}
+	default:
+		rm.removeWaiter(w)
+	}
+	rm.dispatch()
+	return uuid.UUID{}, ctx.Err()
+}
+
+// Make sure a request could ever be satisfied. Must be called with the lock held.
+func (rm *ResourceManager) check(request *ResourceRequest) error {
+	if problems := request.Problems(rm.counts()); len(problems) > 0 {
+		return fmt.Errorf("%s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// The size of every group
+func (rm *ResourceManager) Counts() map[string]int64 {
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+	return rm.counts()
+}
+
+// Must be called with the lock held
+func (rm *ResourceManager) counts() map[string]int64 {
+	counts := make(map[string]int64, len(rm.groups))
+	for name, group := range rm.groups {
+		if !group.Removed {
+			counts[name] = group.Count
+		}
+	}
+	return counts
+}
+
+// Whether the whole request fits right now without touching any blocked group.
+// Must be called with the lock held.
+func (rm *ResourceManager) fits(request *ResourceRequest, blocked map[string]bool) bool {
+	for name, resource := range request.Resources {
+		if blocked[name] || !rm.groups[name].Fits(resource.Count) {
+			return false
+		}
+	}
+	return true
+}
+
+// Groups that someone at or above the priority is already waiting on.
+// Must be called with the lock held.
+func (rm *ResourceManager) queuedGroups(priority int) map[string]bool {
+	groups := map[string]bool{}
+	for _, w := range rm.queue {
+		if w.claim.Priority < priority {
+			continue
+		}
+		for name := range w.request.Resources {
+			groups[name] = true
+		}
+	}
+	return groups
+}
+
+// Take the resources of a request that fits. Must be called with the lock held.
+func (rm *ResourceManager) grant(request *ResourceRequest, claim Claim) *ResourceHandle {
+	for name, resource := range request.Resources {
+		rm.groups[name].TryAcquire(resource.Count)
+	}
+	handle := &ResourceHandle{
+		ID:      uuid.Must(uuid.NewUUID()),
+		Request: request,
+		Created: time.Now(),
+		Claim:   claim,
+	}
+	rm.active[handle.ID] = handle
+	rm.grants++
+	rm.lastServed[claim.Caller] = rm.grants
+	return handle
 }
 
-func (rm *ResourceManager) Acquire(name string, ctx context.Context, n int64) error {
-	return rm.Groups[name].Acquire(ctx, n)
+// Give back the resources of a handle. Must be called with the lock held.
+func (rm *ResourceManager) release(handle *ResourceHandle) {
+	delete(rm.active, handle.ID)
+	for name, resource := range handle.Request.Resources {
+		group, ok := rm.groups[name]
+		if !ok {
+			continue
+		}
+		group.Release(resource.Count)
+		if group.Removed && group.Held == 0 {
+			delete(rm.groups, name)
+		}
+	}
 }
 
-func (rm *ResourceManager) TryAcquireRequest(request *ResourceRequest) (uuid.UUID, error) {
-	acquired := []*ResourceBase{}
-	success := true
-	for _, resource := range request.Resources {
-		if ok := rm.TryAcquire(resource.Name, resource.Count); ok {
-			acquired = append(acquired, resource)
+// Change the groups while the node runs, leaving active handles alone.
+// A group that shrinks below what is held grants nothing new until enough is released,
+// and a removed group that is still held stays around until its last holder is done.
+// Waiters that could never be granted by the new groups are turned away.
+func (rm *ResourceManager) Resize(m map[string]int64) {
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+
+	for name, count := range m {
+		if group, ok := rm.groups[name]; ok {
+			group.Count = count
+			group.Removed = false
 		} else {
-			success = false
-			break
+			rm.groups[name] = NewResourceGroup(name, count)
 		}
 	}
-	if success {
-		handle := ResourceHandle{
-			id:      uuid.Must(uuid.NewUUID()),
-			Request: request,
-			Created: time.Now(),
+	for name, group := range rm.groups {
+		if _, ok := m[name]; ok {
+			continue
+		}
+		if group.Held == 0 {
+			delete(rm.groups, name)
+			continue
 		}
-		rm.Active[handle.id] = &handle
-		return handle.id, nil
-	} else {
-		// If we didn't succeed, put everything back
-		for _, resource := range acquired {
-			rm.Release(resource.Name, resource.Count)
+		group.Count = 0
+		group.Removed = true
+	}
+
+	counts := rm.counts()
+	for _, w := range append([]*waiter{}, rm.queue...) {
+		if problems := w.request.Problems(counts); len(problems) > 0 {
+			rm.removeWaiter(w)
+			w.err = fmt.Errorf("resource groups changed: %s", strings.Join(problems, "; "))
+			close(w.ready)
 		}
-		return uuid.UUID{}, fmt.Errorf("unable to acquire resources")
 	}
+	rm.dispatch()
 }
 
-func (rm *ResourceManager) TryAcquire(name string, n int64) bool {
-	return rm.Groups[name].TryAcquire(n)
+// Hand freed resources to waiters, highest priority first and in arrival order
+// within a priority. A waiter that doesn't fit holds its groups for itself so
+// later, smaller requests can't starve it.
+// Must be called with the lock held.
+func (rm *ResourceManager) dispatch() {
+	// Handles held by each caller, for fair sharing
+	load := map[string]int{}
+	if rm.FairShare {
+		for _, handle := range rm.active {
+			load[handle.Caller]++
+		}
+	}
+
+	blocked := map[string]bool{}
+	remaining := append([]*waiter{}, rm.queue...)
+	waiting := []*waiter{}
+	for len(remaining) > 0 {
+		next := 0
+		for i, w := range remaining {
+			if rm.ahead(w, remaining[next], load) {
+				next = i
+			}
+		}
+		w := remaining[next]
+		remaining = append(remaining[:next], remaining[next+1:]...)
+
+		if rm.fits(w.request, blocked) {
+			w.handle = rm.grant(w.request, w.claim)
+			load[w.claim.Caller]++
+			close(w.ready)
+			continue
+		}
+		for name := range w.request.Resources {
+			blocked[name] = true
+		}
+		waiting = append(waiting, w)
+	}
+	rm.queue = waiting
+	rm.updatePositions()
 }
 
-func (rm *ResourceManager) ReleaseHandle(id uuid.UUID) {
-	// Pop the handle out of the map
-	handle, ok := rm.Active[id]
-	if !ok {
-		return
-	} else {
-		delete(rm.Active, id)
+// Whether waiter a should be served before waiter b
+func (rm *ResourceManager) ahead(a *waiter, b *waiter, load map[string]int) bool {
+	if a.claim.Priority != b.claim.Priority {
+		return a.claim.Priority > b.claim.Priority
+	}
+	if rm.FairShare {
+		if load[a.claim.Caller] != load[b.claim.Caller] {
+			return load[a.claim.Caller] < load[b.claim.Caller]
+		}
+		if rm.lastServed[a.claim.Caller] != rm.lastServed[b.claim.Caller] {
+			return rm.lastServed[a.claim.Caller] < rm.lastServed[b.claim.Caller]
+		}
 	}
-	// Release all held resources
-	for _, resource := range handle.Request.Resources {
-		rm.Release(resource.Name, resource.Count)
+	return a.seq < b.seq
+}
+
+// Must be called with the lock held
+func (rm *ResourceManager) removeWaiter(w *waiter) {
+	for i, other := range rm.queue {
+		if other == w {
+			rm.queue = append(rm.queue[:i], rm.queue[i+1:]...)
+			return
+		}
 	}
 }
 
-func (rm *ResourceManager) Release(name string, n int64) {
-	rm.Groups[name].Release(n)
+// Tell waiters about their new place in line. Must be called with the lock held.
+func (rm *ResourceManager) updatePositions() {
+	for i, w := range rm.queue {
+		if w.position != i+1 {
+			w.position = i + 1
+			if w.onQueued != nil {
+				w.onQueued(w.position)
+			}
+		}
+	}
+}
+
+// Get an active handle. Handles aren't changed once granted, so it is safe to hold on to.
+func (rm *ResourceManager) GetHandle(id uuid.UUID) (*ResourceHandle, bool) {
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+	handle, ok := rm.active[id]
+	return handle, ok
+}
+
+func (rm *ResourceManager) ReleaseHandle(id uuid.UUID) {
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+	handle, ok := rm.active[id]
+	if !ok {
+		return
+	}
+	rm.release(handle)
+	rm.dispatch()
 }
 
 func (r *ResourceManager) UnmarshalYAML(node *yaml.Node) error {
@@ -96,7 +375,9 @@ func (r *ResourceManager) UnmarshalYAML(node *yaml.Node) error {
 		return err
 	}
 
-	r.Groups = NewResourceGroupMap(m)
+	r.groups = NewResourceGroupMap(m)
+	r.active = map[uuid.UUID]*ResourceHandle{}
+	r.lastServed = map[string]uint64{}
 	return nil
 }
 
@@ -106,6 +387,8 @@ func (r *ResourceManager) UnmarshalJSON(data []byte) error {
 		return err
 	}
 
-	r.Groups = NewResourceGroupMap(m)
+	r.groups = NewResourceGroupMap(m)
+	r.active = map[uuid.UUID]*ResourceHandle{}
+	r.lastServed = map[string]uint64{}
 	return nil
 }
@@ -0,0 +1,388 @@
+package resources
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func request(m map[string]int64) *ResourceRequest {
+	return &ResourceRequest{Resources: NewResourceBaseMap(m)}
+}
+
+// What an AcquireRequest running in the background ended with
+type acquired struct {
+	id  uuid.UUID
+	err error
+}
+
+// Start waiting for the request and return once it is in the queue
+func acquireQueued(t *testing.T, rm *ResourceManager, req *ResourceRequest, claim Claim) chan acquired {
+	t.Helper()
+	before := len(rm.Queue())
+	done := make(chan acquired, 1)
+	go func() {
+		id, err := rm.AcquireRequest(context.Background(), req, claim, nil)
+		done <- acquired{id, err}
+	}()
+	deadline := time.Now().Add(time.Second)
+	for len(rm.Queue()) == before {
+		if time.Now().After(deadline) {
+			t.Fatalf("request %v from %s was never queued", req.Resources, claim.Caller)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	return done
+}
+
+func wait(t *testing.T, done chan acquired) acquired {
+	t.Helper()
+	select {
+	case a := <-done:
+		return a
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for resources")
+	}
+	return acquired{}
+}
+
+func assertIdle(t *testing.T, rm *ResourceManager) {
+	t.Helper()
+	snap := rm.Snapshot()
+	for name, group := range snap.Groups {
+		if group.Held != 0 {
+			t.Errorf("group %s still has %d held", name, group.Held)
+		}
+	}
+	if len(snap.Active) != 0 || len(snap.Queue) != 0 {
+		t.Errorf("%d handles still active and %d requests still queued", len(snap.Active), len(snap.Queue))
+	}
+}
+
+// Many goroutines acquiring, releasing, resizing, and looking at the manager at
+// once. Run with -race. Nothing may be granted past the largest size a group
+// ever has, and everything must be handed back at the end.
+func TestManagerStress(t *testing.T) {
+	large := map[string]int64{"a": 10, "b": 5, "c": 3, "d": 2}
+	small := map[string]int64{"a": 4, "b": 2, "c": 3}
+	rm := NewResourceManager(large)
+	rm.FairShare = true
+
+	shapes := []map[string]int64{
+		{"a": 1},
+		{"a": 2, "b": 1},
+		{"b": 2},
+		{"c": 1, "a": 1},
+		{"c": 3},
+		{"d": 1},
+		{"a": 1, "b": 1, "c": 1},
+	}
+	inUse := map[string]*int64{}
+	for name := range large {
+		inUse[name] = new(int64)
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 200)
+	for g := 0; g < 200; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			random := rand.New(rand.NewSource(int64(g)))
+			claim := Claim{Priority: random.Intn(3), Caller: string(rune('A' + g%5))}
+			for i := 0; i < 25; i++ {
+				switch g % 10 {
+				case 0:
+					if random.Intn(2) == 0 {
+						rm.Resize(large)
+					} else {
+						rm.Resize(small)
+					}
+					continue
+				case 1:
+					rm.Snapshot()
+					rm.Queue()
+					rm.Counts()
+					continue
+				}
+
+				shape := shapes[random.Intn(len(shapes))]
+				req := request(shape)
+				var id uuid.UUID
+				var err error
+				if random.Intn(4) == 0 {
+					id, err = rm.TryAcquireRequest(req, claim)
+				} else {
+					ctx, cancel := context.WithTimeout(context.Background(), time.Duration(random.Intn(20))*time.Millisecond)
+					id, err = rm.AcquireRequest(ctx, req, claim, func(int) {})
+					cancel()
+				}
+				if err != nil {
+					// Requests can lose the race with a resize, a timeout, or someone else
+					if !errors.Is(err, ErrUnavailable) && !errors.Is(err, context.DeadlineExceeded) &&
+						!strings.Contains(err.Error(), "resource group") {
+						errs <- err
+						return
+					}
+					continue
+				}
+				for name, count := range shape {
+					if n := atomic.AddInt64(inUse[name], count); n > large[name] {
+						errs <- errors.New("group " + name + " was handed out past its size")
+					}
+				}
+				if _, ok := rm.GetHandle(id); !ok {
+					errs <- errors.New("granted handle isn't active")
+				}
+				time.Sleep(time.Duration(random.Intn(200)) * time.Microsecond)
+				for name, count := range shape {
+					atomic.AddInt64(inUse[name], -count)
+				}
+				rm.ReleaseHandle(id)
+			}
+		}(g)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+
+	rm.Resize(large)
+	assertIdle(t, rm)
+}
+
+// Higher priorities go first, then requests in the order they arrived
+func TestManagerQueueOrder(t *testing.T) {
+	rm := NewResourceManager(map[string]int64{"x": 1})
+	holder, err := rm.TryAcquireRequest(request(map[string]int64{"x": 1}), Claim{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	claims := []Claim{
+		{Priority: 0, Job: "low-1"},
+		{Priority: 5, Job: "high-1"},
+		{Priority: 0, Job: "low-2"},
+		{Priority: 5, Job: "high-2"},
+		{Priority: 1, Job: "mid"},
+	}
+	waiting := map[string]chan acquired{}
+	for _, claim := range claims {
+		waiting[claim.Job] = acquireQueued(t, rm, request(map[string]int64{"x": 1}), claim)
+	}
+	if _, err := rm.TryAcquireRequest(request(map[string]int64{"x": 1}), Claim{Priority: 10}); !errors.Is(err, ErrUnavailable) {
+		t.Errorf("TryAcquireRequest of a held group: got %v", err)
+	}
+
+	queue := rm.Queue()
+	for i, job := range []string{"high-1", "high-2", "mid", "low-1", "low-2"} {
+		if queue[i].Job != job || queue[i].Position != i+1 {
+			t.Errorf("queue position %d: got %s at %d, want %s", i+1, queue[i].Job, queue[i].Position, job)
+		}
+	}
+
+	rm.ReleaseHandle(holder)
+	for _, job := range []string{"high-1", "high-2", "mid", "low-1", "low-2"} {
+		a := wait(t, waiting[job])
+		if a.err != nil {
+			t.Fatal(a.err)
+		}
+		if others := rm.Snapshot().Active; len(others) != 1 || others[0].Job != job {
+			t.Fatalf("expected %s to be the only one holding x, got %v", job, others)
+		}
+		rm.ReleaseHandle(a.id)
+	}
+	assertIdle(t, rm)
+}
+
+// A large request at the front isn't starved by smaller ones behind it
+func TestManagerLargeRequestNotStarved(t *testing.T) {
+	rm := NewResourceManager(map[string]int64{"x": 2})
+	first, _ := rm.TryAcquireRequest(request(map[string]int64{"x": 1}), Claim{})
+	large := acquireQueued(t, rm, request(map[string]int64{"x": 2}), Claim{Job: "large"})
+	small := acquireQueued(t, rm, request(map[string]int64{"x": 1}), Claim{Job: "small"})
+
+	// One is free, but the large request is ahead of the small one
+	if got := len(rm.Queue()); got != 2 {
+		t.Fatalf("expected both requests to wait, %d are queued", got)
+	}
+	rm.ReleaseHandle(first)
+	a := wait(t, large)
+	if a.err != nil {
+		t.Fatal(a.err)
+	}
+	rm.ReleaseHandle(a.id)
+	b := wait(t, small)
+	rm.ReleaseHandle(b.id)
+	assertIdle(t, rm)
+}
+
+// Callers holding less are served first, then those served longest ago
+func TestManagerFairShare(t *testing.T) {
+	rm := NewResourceManager(map[string]int64{"x": 2})
+	rm.FairShare = true
+	heldByA, _ := rm.TryAcquireRequest(request(map[string]int64{"x": 1}), Claim{Caller: "a"})
+	heldByC, _ := rm.TryAcquireRequest(request(map[string]int64{"x": 1}), Claim{Caller: "c"})
+
+	fromA := acquireQueued(t, rm, request(map[string]int64{"x": 1}), Claim{Caller: "a"})
+	fromB := acquireQueued(t, rm, request(map[string]int64{"x": 1}), Claim{Caller: "b"})
+	if queue := rm.Queue(); queue[0].Caller != "b" {
+		t.Errorf("expected b, who holds nothing, at the front, got %s", queue[0].Caller)
+	}
+
+	rm.ReleaseHandle(heldByC)
+	b := wait(t, fromB)
+	if b.err != nil {
+		t.Fatal(b.err)
+	}
+	select {
+	case <-fromA:
+		t.Fatal("a was served while holding more than b")
+	default:
+	}
+
+	// With equal loads, whoever was served longest ago goes first
+	rm.ReleaseHandle(heldByA)
+	a := wait(t, fromA)
+	rm.ReleaseHandle(a.id)
+	rm.ReleaseHandle(b.id)
+
+	last, _ := rm.TryAcquireRequest(request(map[string]int64{"x": 2}), Claim{Caller: "c"})
+	againA := acquireQueued(t, rm, request(map[string]int64{"x": 1}), Claim{Caller: "a"})
+	againB := acquireQueued(t, rm, request(map[string]int64{"x": 1}), Claim{Caller: "b"})
+	if queue := rm.Queue(); queue[0].Caller != "b" {
+		t.Errorf("expected b, served before a, at the front, got %s", queue[0].Caller)
+	}
+	rm.ReleaseHandle(last)
+	rm.ReleaseHandle(wait(t, againA).id)
+	rm.ReleaseHandle(wait(t, againB).id)
+	assertIdle(t, rm)
+}
+
+// Shrinking a group below what is held keeps the holders and grants nothing new until they release
+func TestManagerResizeBelowHeld(t *testing.T) {
+	rm := NewResourceManager(map[string]int64{"x": 4})
+	held, err := rm.TryAcquireRequest(request(map[string]int64{"x": 3}), Claim{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tooLarge := acquireQueued(t, rm, request(map[string]int64{"x": 4}), Claim{Job: "too-large"})
+
+	rm.Resize(map[string]int64{"x": 2})
+	if a := wait(t, tooLarge); a.err == nil || !strings.Contains(a.err.Error(), "resource groups changed") {
+		t.Errorf("expected a request larger than the new size to be turned away, got %v", a.err)
+	}
+	group := rm.Snapshot().Groups["x"]
+	if group.Count != 2 || group.Held != 3 || group.Free != 0 {
+		t.Errorf("got %+v after shrinking below held", group)
+	}
+	if _, err := rm.TryAcquireRequest(request(map[string]int64{"x": 1}), Claim{}); !errors.Is(err, ErrUnavailable) {
+		t.Errorf("expected nothing to be free, got %v", err)
+	}
+	if _, err := rm.AcquireRequest(context.Background(), request(map[string]int64{"x": 3}), Claim{}, nil); err == nil {
+		t.Error("expected a request larger than the group to fail")
+	}
+
+	waiter := acquireQueued(t, rm, request(map[string]int64{"x": 2}), Claim{})
+	rm.ReleaseHandle(held)
+	a := wait(t, waiter)
+	if a.err != nil {
+		t.Fatal(a.err)
+	}
+	rm.ReleaseHandle(a.id)
+	assertIdle(t, rm)
+}
+
+// A removed group that is still held stays until its last holder releases it
+func TestManagerRemovedGroup(t *testing.T) {
+	rm := NewResourceManager(map[string]int64{"x": 2, "y": 1})
+	held, err := rm.TryAcquireRequest(request(map[string]int64{"x": 1, "y": 1}), Claim{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	waiter := acquireQueued(t, rm, request(map[string]int64{"y": 1}), Claim{})
+	onRemoved := acquireQueued(t, rm, request(map[string]int64{"x": 1, "y": 1}), Claim{})
+
+	rm.Resize(map[string]int64{"y": 1})
+	if a := wait(t, onRemoved); a.err == nil || !strings.Contains(a.err.Error(), "resource group x") {
+		t.Errorf("expected a waiter on a removed group to be turned away, got %v", a.err)
+	}
+	group, ok := rm.Snapshot().Groups["x"]
+	if !ok || !group.Removed || group.Count != 0 || group.Held != 1 {
+		t.Errorf("got %+v (present: %v) for a removed group that is still held", group, ok)
+	}
+	if _, ok := rm.Counts()["x"]; ok {
+		t.Error("a removed group is still counted")
+	}
+	if _, err := rm.TryAcquireRequest(request(map[string]int64{"x": 1}), Claim{}); err == nil || errors.Is(err, ErrUnavailable) {
+		t.Errorf("expected asking for a removed group to be an error, got %v", err)
+	}
+
+	rm.ReleaseHandle(held)
+	if _, ok := rm.Snapshot().Groups["x"]; ok {
+		t.Error("a removed group outlived its last holder")
+	}
+	a := wait(t, waiter)
+	if a.err != nil {
+		t.Fatal(a.err)
+	}
+	rm.ReleaseHandle(a.id)
+
+	// Adding it back starts it over
+	rm.Resize(map[string]int64{"x": 1, "y": 1})
+	if group := rm.Snapshot().Groups["x"]; group.Removed || group.Count != 1 || group.Held != 0 {
+		t.Errorf("got %+v for a group added back", group)
+	}
+	assertIdle(t, rm)
+}
+
+func TestRequestProblems(t *testing.T) {
+	groups := map[string]int64{"x": 2, "y": 1}
+	tests := []struct {
+		request  map[string]int64
+		problems []string
+	}{
+		{map[string]int64{"x": 2, "y": 1}, nil},
+		{map[string]int64{"x": 3}, []string{"which only has 2"}},
+		{map[string]int64{"x": 0}, []string{"at least 1"}},
+		{map[string]int64{"x": -1}, []string{"at least 1"}},
+		{map[string]int64{"z": 1, "y": 0}, []string{"at least 1", "not declared"}},
+	}
+	for _, test := range tests {
+		problems := request(test.request).Problems(groups)
+		if len(problems) != len(test.problems) {
+			t.Errorf("%v: got %q", test.request, problems)
+			continue
+		}
+		for i, want := range test.problems {
+			if !strings.Contains(problems[i], want) {
+				t.Errorf("%v: got %q, want %q", test.request, problems[i], want)
+			}
+		}
+	}
+}
+
+func TestManagerReleaseAfterGroupDropped(t *testing.T) {
+	rm := NewResourceManager(map[string]int64{"x": 1, "y": 1})
+	if _, err := rm.TryAcquireRequest(request(map[string]int64{"x": 0}), Claim{}); err == nil {
+		t.Error("expected a request for none of a group to be refused")
+	}
+	held, err := rm.TryAcquireRequest(request(map[string]int64{"y": 1}), Claim{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Releasing a handle whose group is already gone must not take the manager down
+	rm.mu.Lock()
+	delete(rm.groups, "y")
+	rm.mu.Unlock()
+	rm.ReleaseHandle(held)
+	assertIdle(t, rm)
+}
@@ -2,6 +2,8 @@ package resources
 
 import (
 	"encoding/json"
+	"fmt"
+	"sort"
 
 	"gopkg.in/yaml.v3"
 )
@@ -29,3 +31,36 @@ func (r *ResourceRequest) UnmarshalJSON(data []byte) error {
 	r.Resources = NewResourceBaseMap(m)
 	return nil
 }
+
+// Marshal back into the same name: count form that requests are read from
+func (r ResourceRequest) MarshalJSON() ([]byte, error) {
+	m := map[string]int64{}
+	for name, resource := range r.Resources {
+		m[name] = resource.Count
+	}
+	return json.Marshal(m)
+}
+
+// Everything that stops the request from ever being granted by the given groups
+func (r *ResourceRequest) Problems(groups map[string]int64) []string {
+	names := make([]string, 0, len(r.Resources))
+	for name := range r.Resources {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	problems := []string{}
+	for _, name := range names {
+		count := r.Resources[name].Count
+		available, ok := groups[name]
+		switch {
+		case !ok:
+			problems = append(problems, fmt.Sprintf("resource group %s is not declared in resource-groups", name))
+		case count < 1:
+			problems = append(problems, fmt.Sprintf("requests %d of resource group %s; counts must be at least 1", count, name))
+		case count > available:
+			problems = append(problems, fmt.Sprintf("requests %d of resource group %s, which only has %d", count, name, available))
+		}
+	}
+	return problems
+}
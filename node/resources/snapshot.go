@@ -0,0 +1,102 @@
+package resources
+
+import (
+	"encoding/json"
+	"sort"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// The state of a resource manager at one moment
+type Snapshot struct {
+	Taken     time.Time                `json:"taken"`
+	Groups    map[string]GroupSnapshot `json:"groups"`
+	Active    []HandleSnapshot         `json:"active"`
+	Queue     []QueuedRequest          `json:"queue"`
+	FairShare bool                     `json:"fair_share"`
+}
+
+type GroupSnapshot struct {
+	Count int64 `json:"count"`
+	Held  int64 `json:"held"`
+	Free  int64 `json:"free"`
+	// No longer configured; waiting for its holders to finish
+	Removed bool `json:"removed,omitempty"`
+}
+
+type HandleSnapshot struct {
+	ID      uuid.UUID        `json:"id"`
+	Request *ResourceRequest `json:"request"`
+	Created time.Time        `json:"created"`
+	Age     string           `json:"age"`
+	Claim
+}
+
+// A request waiting in the queue, in the order they will be served
+type QueuedRequest struct {
+	Position int              `json:"position"`
+	Request  *ResourceRequest `json:"request"`
+	Since    time.Time        `json:"since"`
+	Waited   string           `json:"waited"`
+	Claim
+}
+
+// Copy out the groups, active handles, and queue as they are right now
+func (rm *ResourceManager) Snapshot() Snapshot {
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+
+	now := time.Now()
+	snap := Snapshot{
+		Taken:     now,
+		Groups:    make(map[string]GroupSnapshot, len(rm.groups)),
+		Active:    make([]HandleSnapshot, 0, len(rm.active)),
+		Queue:     make([]QueuedRequest, 0, len(rm.queue)),
+		FairShare: rm.FairShare,
+	}
+	for name, group := range rm.groups {
+		free := group.Count - group.Held
+		if free < 0 {
+			// Shrunk below what is held
+			free = 0
+		}
+		snap.Groups[name] = GroupSnapshot{
+			Count:   group.Count,
+			Held:    group.Held,
+			Free:    free,
+			Removed: group.Removed,
+		}
+	}
+	for _, handle := range rm.active {
+		snap.Active = append(snap.Active, HandleSnapshot{
+			ID:      handle.ID,
+			Request: handle.Request,
+			Created: handle.Created,
+			Age:     now.Sub(handle.Created).Round(time.Millisecond).String(),
+			Claim:   handle.Claim,
+		})
+	}
+	sort.Slice(snap.Active, func(i, j int) bool {
+		return snap.Active[i].Created.Before(snap.Active[j].Created)
+	})
+	for _, w := range rm.queue {
+		snap.Queue = append(snap.Queue, QueuedRequest{
+			Position: w.position,
+			Request:  w.request,
+			Since:    w.since,
+			Waited:   now.Sub(w.since).Round(time.Millisecond).String(),
+			Claim:    w.claim,
+		})
+	}
+	return snap
+}
+
+// Requests waiting for resources, in the order they will be served
+func (rm *ResourceManager) Queue() []QueuedRequest {
+	return rm.Snapshot().Queue
+}
+
+func (rm *ResourceManager) MarshalJSON() ([]byte, error) {
+	return json.Marshal(rm.Snapshot())
+}
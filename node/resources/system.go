@@ -0,0 +1,46 @@
+package resources
+
+import (
+	"fmt"
+	"runtime"
+)
+
+// Names of the groups detected from the machine
+const (
+	CPUGroup        = "cpu"
+	MemoryGroup     = "memory_mb"
+	DiskGroupPrefix = "disk_mb:"
+)
+
+// Which groups to detect from the machine the node runs on
+type SystemResources struct {
+	// Number of cores, as the cpu group
+	CPU bool `yaml:"cpu"`
+	// Total memory in MiB, as the memory_mb group
+	Memory bool `yaml:"memory"`
+	// Size in MiB of the filesystem at each mount, as disk_mb:<mount> groups
+	Disks []string `yaml:"disks"`
+}
+
+// Measure the machine and build the groups that were asked for
+func (s SystemResources) Detect() (map[string]int64, error) {
+	groups := map[string]int64{}
+	if s.CPU {
+		groups[CPUGroup] = int64(runtime.NumCPU())
+	}
+	if s.Memory {
+		mb, err := memoryMB()
+		if err != nil {
+			return nil, fmt.Errorf("detecting memory: %w", err)
+		}
+		groups[MemoryGroup] = mb
+	}
+	for _, mount := range s.Disks {
+		mb, err := diskMB(mount)
+		if err != nil {
+			return nil, fmt.Errorf("detecting disk %s: %w", mount, err)
+		}
+		groups[DiskGroupPrefix+mount] = mb
+	}
+	return groups, nil
+}
@@ -0,0 +1,16 @@
+//go:build !linux
+
+package resources
+
+import (
+	"fmt"
+	"runtime"
+)
+
+func memoryMB() (int64, error) {
+	return 0, fmt.Errorf("not supported on %s", runtime.GOOS)
+}
+
+func diskMB(path string) (int64, error) {
+	return 0, fmt.Errorf("not supported on %s", runtime.GOOS)
+}
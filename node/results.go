@@ -0,0 +1,77 @@
+package node
+
+import (
+	"time"
+	"unicode/utf8"
+)
+
+// Most bytes of stdout, and of stderr, kept in each command's result. The end is kept.
+const CommandOutputLimit = 64 * 1024
+
+// The outcome of running a single command of an action
+type CommandResult struct {
+	Command  []string `json:"command"`
+	ExitCode int      `json:"exit_code"`
+	Stdout   string   `json:"stdout"`
+	Stderr   string   `json:"stderr"`
+	// Stdout or stderr went over CommandOutputLimit and only the end of it was kept
+	Truncated bool   `json:"truncated,omitempty"`
+	Error     string `json:"error,omitempty"`
+	// The sandbox's cgroup ran out of memory while the command ran
+	OOMKilled bool      `json:"oom_killed,omitempty"`
+	Start     time.Time `json:"start"`
+	End       time.Time `json:"end"`
+	Duration  Duration  `json:"duration"`
+}
+
+func (r CommandResult) Succeeded() bool {
+	return r.Error == "" && r.ExitCode == 0
+}
+
+func exitCodes(results []CommandResult) []int {
+	codes := make([]int, len(results))
+	for i, r := range results {
+		codes[i] = r.ExitCode
+	}
+	return codes
+}
+
+// An io.Writer that keeps only the last limit bytes written to it
+type tailBuffer struct {
+	buf     []byte
+	limit   int
+	written int64
+}
+
+func newTailBuffer(limit int) *tailBuffer {
+	return &tailBuffer{limit: limit}
+}
+
+func (b *tailBuffer) Write(p []byte) (int, error) {
+	b.written += int64(len(p))
+	b.buf = append(b.buf, p...)
+	// Let the buffer grow to twice the limit so it isn't copied on every write
+	if len(b.buf) > 2*b.limit {
+		b.buf = append(b.buf[:0], b.buf[len(b.buf)-b.limit:]...)
+	}
+	return len(p), nil
+}
+
+// Whether anything had to be thrown away
+func (b *tailBuffer) Truncated() bool {
+	return b.written > int64(b.limit)
+}
+
+func (b *tailBuffer) String() string {
+	tail := b.buf
+	if len(tail) > b.limit {
+		tail = tail[len(tail)-b.limit:]
+	}
+	if b.Truncated() {
+		// Don't start in the middle of a character
+		for len(tail) > 0 && !utf8.RuneStart(tail[0]) {
+			tail = tail[1:]
+		}
+	}
+	return string(tail)
+}
@@ -0,0 +1,31 @@
+package node
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestTailBufferKeepsTheEnd(t *testing.T) {
+	tests := []struct {
+		writes    []string
+		want      string
+		truncated bool
+	}{
+		{[]string{"abc", "de"}, "abcde", false},
+		{[]string{"abcdefgh"}, "abcdefgh", false},
+		{[]string{"abcdefgh", "i"}, "bcdefghi", true},
+		{[]string{strings.Repeat("x", 100), "12345678"}, "12345678", true},
+		{[]string{"a", "b", "c", "d", "e", "f", "g", "h", "i", "j", "k", "l", "m", "n", "o", "p", "q"}, "jklmnopq", true},
+		// The start of a cut character is dropped too
+		{[]string{"éééé", "a"}, "éééa", true},
+	}
+	for _, test := range tests {
+		b := newTailBuffer(8)
+		for _, w := range test.writes {
+			b.Write([]byte(w))
+		}
+		if got := b.String(); got != test.want || b.Truncated() != test.truncated {
+			t.Errorf("writing %q: got %q (truncated %v), want %q (truncated %v)", test.writes, got, b.Truncated(), test.want, test.truncated)
+		}
+	}
+}
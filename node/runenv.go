@@ -0,0 +1,222 @@
+package node
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"os/user"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Where and as whom the commands of an action run
+type runEnv struct {
+	env   []string
+	dir   string
+	cred  *credential
+	umask string
+	// Set when the commands run in a sandbox
+	sandbox *sandboxRun
+}
+
+// The ids commands run as
+type credential struct {
+	Uid    uint32
+	Gid    uint32
+	Groups []uint32
+}
+
+// Work out the environment, directory, and credentials for running the action with params.
+// Errors name the action.
+func (a Action) prepareRun(params any) (*runEnv, error) {
+	r := &runEnv{}
+	fail := func(err error) (*runEnv, error) {
+		return nil, fmt.Errorf("action %s: %w", a.Name, err)
+	}
+
+	if a.Workdir != "" {
+		dir, err := renderTemplate(a.Name, a.Workdir, params)
+		if err != nil {
+			return fail(fmt.Errorf("workdir: %w", err))
+		}
+		// exec only reports a missing directory as the command not being found
+		if info, err := os.Stat(dir); err != nil {
+			return fail(fmt.Errorf("workdir: %w", err))
+		} else if !info.IsDir() {
+			return fail(fmt.Errorf("workdir %s isn't a directory", dir))
+		}
+		r.dir = dir
+	}
+
+	if a.Umask != "" {
+		if !runAsSupported {
+			return fail(fmt.Errorf("actions can't set a umask on %s", runtime.GOOS))
+		}
+		mask, err := strconv.ParseUint(a.Umask, 8, 32)
+		if err != nil || mask > 0777 {
+			return fail(fmt.Errorf("umask %q isn't an octal mask like 027", a.Umask))
+		}
+		r.umask = fmt.Sprintf("%04o", mask)
+	}
+
+	cred, account, err := lookupCredential(a.User, a.Group)
+	if err != nil {
+		return fail(err)
+	}
+	if a.Sandbox != nil && a.Sandbox.locked {
+		// Whatever the action asks for, commands the node forces into a sandbox never run as root
+		cred, account = sandboxCredential()
+	}
+	r.cred = cred
+
+	env := map[string]string{}
+	if a.InheritEnv == nil || *a.InheritEnv {
+		for _, kv := range os.Environ() {
+			if k, v, ok := strings.Cut(kv, "="); ok {
+				env[k] = v
+			}
+		}
+	}
+	if account != nil {
+		env["HOME"] = account.HomeDir
+		env["USER"] = account.Username
+		env["LOGNAME"] = account.Username
+	}
+	for k, v := range a.Env {
+		if k == "" || strings.ContainsAny(k, "=\x00") {
+			return fail(fmt.Errorf("invalid env variable name %q", k))
+		}
+		rendered, err := renderTemplate(a.Name, v, params)
+		if err != nil {
+			return fail(fmt.Errorf("env %s: %w", k, err))
+		}
+		env[k] = rendered
+	}
+	if a.Sandbox != nil {
+		// Setting up the namespaces and mounts needs root
+		if os.Geteuid() != 0 {
+			return fail(fmt.Errorf("the node must run as root to run sandboxed actions"))
+		}
+		r.sandbox = &sandboxRun{
+			network:    a.Sandbox.Network,
+			pids:       a.Sandbox.Pids,
+			cgroupRoot: a.Sandbox.cgroupRoot,
+		}
+		if !a.Sandbox.locked {
+			r.sandbox.writable = append(r.sandbox.writable, a.Sandbox.Writable...)
+			if r.dir != "" {
+				r.sandbox.writable = append(r.sandbox.writable, r.dir)
+			}
+		}
+	}
+
+	r.env = make([]string, 0, len(env))
+	for k, v := range env {
+		r.env = append(r.env, k+"="+v)
+	}
+	sort.Strings(r.env)
+	return r, nil
+}
+
+// The command to exec for args. A umask can only be set from inside the new
+// process, so a shell sets it and then execs the command.
+func (r *runEnv) command(args []string) *exec.Cmd {
+	if r.sandbox != nil {
+		return r.sandbox.command(r, args)
+	}
+	if r.umask != "" {
+		args = append([]string{"/bin/sh", "-c", fmt.Sprintf(`umask %s && exec "$@"`, r.umask), "sh"}, args...)
+	}
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Env = r.env
+	cmd.Dir = r.dir
+	if r.cred != nil {
+		setCredential(cmd, r.cred)
+	}
+	return cmd
+}
+
+// Find the ids to run as. Switching needs the node to be root; asking for the
+// node's own user and group is allowed either way. The user's account is
+// returned when one was asked for so its home can be used.
+func lookupCredential(userName string, groupName string) (*credential, *user.User, error) {
+	if userName == "" && groupName == "" {
+		return nil, nil, nil
+	}
+	if !runAsSupported {
+		return nil, nil, fmt.Errorf("actions can't set a user or group on %s", runtime.GOOS)
+	}
+
+	cred := &credential{
+		Uid: uint32(os.Getuid()),
+		Gid: uint32(os.Getgid()),
+	}
+	var account *user.User
+	if userName != "" {
+		var err error
+		if isNumeric(userName) {
+			account, err = user.LookupId(userName)
+		} else {
+			account, err = user.Lookup(userName)
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		uid, _ := strconv.ParseUint(account.Uid, 10, 32)
+		gid, _ := strconv.ParseUint(account.Gid, 10, 32)
+		cred.Uid, cred.Gid = uint32(uid), uint32(gid)
+		if ids, err := account.GroupIds(); err == nil {
+			for _, id := range ids {
+				if gid, err := strconv.ParseUint(id, 10, 32); err == nil {
+					cred.Groups = append(cred.Groups, uint32(gid))
+				}
+			}
+		}
+	}
+	if groupName != "" {
+		var group *user.Group
+		var err error
+		if isNumeric(groupName) {
+			group, err = user.LookupGroupId(groupName)
+		} else {
+			group, err = user.LookupGroup(groupName)
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		gid, _ := strconv.ParseUint(group.Gid, 10, 32)
+		cred.Gid = uint32(gid)
+	}
+
+	if os.Geteuid() != 0 {
+		if cred.Uid == uint32(os.Getuid()) && cred.Gid == uint32(os.Getgid()) {
+			// Already running as them
+			return nil, account, nil
+		}
+		return nil, nil, fmt.Errorf("the node must run as root to run actions as user %q group %q", userName, groupName)
+	}
+	return cred, account, nil
+}
+
+// The unprivileged user locked sandboxes run as
+func sandboxCredential() (*credential, *user.User) {
+	cred := &credential{Uid: SandboxNobody, Gid: SandboxNobody}
+	account, err := user.Lookup(SandboxUser)
+	if err != nil {
+		return cred, nil
+	}
+	uid, err := strconv.ParseUint(account.Uid, 10, 32)
+	if err != nil || uid == 0 {
+		return cred, nil
+	}
+	gid, _ := strconv.ParseUint(account.Gid, 10, 32)
+	cred.Uid, cred.Gid = uint32(uid), uint32(gid)
+	return cred, account
+}
+
+func isNumeric(s string) bool {
+	_, err := strconv.ParseUint(s, 10, 32)
+	return err == nil
+}
@@ -0,0 +1,12 @@
+//go:build !unix
+
+package node
+
+import (
+	"os/exec"
+)
+
+// Commands always run as the node, and without a umask
+const runAsSupported = false
+
+func setCredential(cmd *exec.Cmd, cred *credential) {}
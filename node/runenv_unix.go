@@ -0,0 +1,19 @@
+//go:build unix
+
+package node
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// Commands can be run as another user and with their own umask
+const runAsSupported = true
+
+func setCredential(cmd *exec.Cmd, cred *credential) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Credential: &syscall.Credential{
+		Uid:    cred.Uid,
+		Gid:    cred.Gid,
+		Groups: cred.Groups,
+	}}
+}
@@ -0,0 +1,166 @@
+package node
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/urfave/cli/v2"
+	"gopkg.in/yaml.v3"
+)
+
+// Name of the hidden command the node re-executes itself as to set up a sandbox
+const SandboxExecCommand = "sandbox-exec"
+
+// Exit code of sandbox-exec when the sandbox couldn't be set up
+const SandboxSetupFailed = 125
+
+// User that sandboxes the node forces on ad-hoc actions run as
+const SandboxUser = "nobody"
+
+// Id used for SandboxUser when the node has no such account
+const SandboxNobody = 65534
+
+// How an action's commands are isolated from the node. Sandboxed commands run in
+// their own mount, pid, ipc, uts and network namespaces with a read-only view of
+// the node's filesystem. Only the workdir, the writable dirs, and a private /tmp
+// can be written, /dev only has null, zero, full, random, urandom and tty, and
+// the commands can't hold any capabilities, even as root. Can be configured as
+// `sandbox: true` or as a mapping:
+//
+//	sandbox:
+//	  writable: ["/srv/cache"]
+//	  network: true
+//	  pids: 128
+//
+// When the node has a sandbox cgroup, each run gets its own cgroup limited to the
+// cpu and memory_mb the action requests.
+type Sandbox struct {
+	// Directories the commands may write to besides the workdir and /tmp
+	Writable []string `yaml:"writable" json:"writable,omitempty"`
+	// Keep the node's network instead of running without one
+	Network bool `yaml:"network" json:"network,omitempty"`
+	// Most processes the run may have at once; the node's default when 0
+	Pids int64 `yaml:"pids" json:"pids,omitempty"`
+	// Set by `sandbox: false`
+	disabled bool
+	// Forced on by the node; nothing but /tmp is writable and commands run as SandboxUser
+	locked bool
+	// cgroup v2 directory runs get a cgroup in, from the node's config
+	cgroupRoot string
+}
+
+// Avoid recursing into the custom unmarshallers
+type sandboxFields Sandbox
+
+func (s *Sandbox) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.ScalarNode {
+		var enabled bool
+		if err := node.Decode(&enabled); err != nil {
+			return err
+		}
+		s.disabled = !enabled
+		return nil
+	}
+	return node.Decode((*sandboxFields)(s))
+}
+
+func (s *Sandbox) UnmarshalJSON(data []byte) error {
+	var enabled bool
+	if err := json.Unmarshal(data, &enabled); err == nil {
+		s.disabled = !enabled
+		return nil
+	}
+	return json.Unmarshal(data, (*sandboxFields)(s))
+}
+
+// Node wide sandbox settings
+type SandboxConfig struct {
+	// cgroup v2 directory to create a cgroup per sandboxed run in. Runs aren't limited without it.
+	Cgroup string `yaml:"cgroup"`
+	// Sandbox every ad-hoc action, whatever it asks for
+	AdHoc bool `yaml:"adhoc"`
+	// Default process limit for sandboxed runs; 0 for none
+	Pids int64 `yaml:"pids"`
+}
+
+// Fill in the node's settings for the action's sandbox, if it has one
+func (c SandboxConfig) apply(a *Action) {
+	if a.Sandbox != nil && a.Sandbox.disabled {
+		a.Sandbox = nil
+	}
+	if a.Sandbox == nil {
+		return
+	}
+	a.Sandbox.cgroupRoot = c.Cgroup
+	if a.Sandbox.Pids == 0 {
+		a.Sandbox.Pids = c.Pids
+	}
+}
+
+// Sandbox an ad-hoc action the node's way when it is set to
+func (c SandboxConfig) applyAdHoc(a *Action) {
+	if c.AdHoc {
+		a.Sandbox = &Sandbox{locked: true}
+	}
+	c.apply(a)
+}
+
+// The hidden command that sets up the sandbox from inside its namespaces and then runs the action's command
+func GetSandboxExecCommand() *cli.Command {
+	return &cli.Command{
+		Name:   SandboxExecCommand,
+		Usage:  "Run a command inside a gorch sandbox (used by the node)",
+		Hidden: true,
+		Flags: []cli.Flag{
+			&cli.StringFlag{Name: "cgroup"},
+			&cli.StringFlag{Name: "workdir"},
+			&cli.StringSliceFlag{Name: "writable"},
+			&cli.StringFlag{Name: "umask"},
+			&cli.IntFlag{Name: "uid", Value: -1},
+			&cli.IntFlag{Name: "gid", Value: -1},
+			&cli.IntSliceFlag{Name: "groups"},
+		},
+		Action: func(cCtx *cli.Context) error {
+			if cCtx.NArg() == 0 {
+				return cli.Exit("sandbox: no command to run", SandboxSetupFailed)
+			}
+			err := runSandboxExec(sandboxExecOptions{
+				Cgroup:   cCtx.String("cgroup"),
+				Workdir:  cCtx.String("workdir"),
+				Writable: cCtx.StringSlice("writable"),
+				Umask:    cCtx.String("umask"),
+				Uid:      cCtx.Int("uid"),
+				Gid:      cCtx.Int("gid"),
+				Groups:   cCtx.IntSlice("groups"),
+			}, cCtx.Args().Slice())
+			if err != nil {
+				return cli.Exit(fmt.Sprintf("sandbox: %s", err), SandboxSetupFailed)
+			}
+			return nil
+		},
+	}
+}
+
+// What sandbox-exec is told to set up
+type sandboxExecOptions struct {
+	Cgroup   string
+	Workdir  string
+	Writable []string
+	Umask    string
+	// -1 to keep running as root
+	Uid    int
+	Gid    int
+	Groups []int
+}
+
+// A sandboxed run of an action
+type sandboxRun struct {
+	writable   []string
+	network    bool
+	pids       int64
+	cgroupRoot string
+	// The run's own cgroup once it has been created
+	cgroup string
+	// The memory limit of the cgroup, for reporting OOM kills
+	memoryMB int64
+}
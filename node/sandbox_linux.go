@@ -0,0 +1,476 @@
+//go:build linux
+
+package node
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"github.com/bofrim/gorch/node/resources"
+	"github.com/google/uuid"
+)
+
+// Length of the cgroup cpu.max period, in microseconds
+const cgroupCPUPeriod = 100000
+
+// How long a finished run's processes get to go away before its cgroup is left behind
+const cgroupRemoveTimeout = time.Second
+
+// Carries the action's environment through sandbox-exec to the command
+const sandboxEnvVar = "GORCH_SANDBOX_ENV"
+
+// prctl options and capability bits not in package syscall
+const (
+	prCapbsetDrop      = 24
+	prSetSecurebits    = 28
+	prSetNoNewPrivs    = 38
+	prCapAmbient       = 47
+	prCapAmbientClear  = 4
+	secbitNoroot       = 1 << 0
+	secbitNorootLocked = 1 << 1
+	capabilityVersion3 = 0x20080522
+)
+
+// Device nodes every sandbox gets in its /dev, by major and minor number
+var sandboxDevices = map[string][2]uint32{
+	"null":    {1, 3},
+	"zero":    {1, 5},
+	"full":    {1, 7},
+	"random":  {1, 8},
+	"urandom": {1, 9},
+	"tty":     {5, 0},
+}
+
+// Create the run's cgroup, limited to the cpu and memory the request asks for
+func (s *sandboxRun) start(req resources.ResourceRequest) error {
+	if s.cgroupRoot == "" {
+		return nil
+	}
+
+	limits := map[string]string{}
+	controllers := []string{}
+	if cpu, ok := req.Resources[resources.CPUGroup]; ok && cpu.Count > 0 {
+		limits["cpu.max"] = fmt.Sprintf("%d %d", cpu.Count*cgroupCPUPeriod, cgroupCPUPeriod)
+		controllers = append(controllers, "cpu")
+	}
+	if memory, ok := req.Resources[resources.MemoryGroup]; ok && memory.Count > 0 {
+		s.memoryMB = memory.Count
+		limits["memory.max"] = strconv.FormatInt(memory.Count*1024*1024, 10)
+		controllers = append(controllers, "memory")
+	}
+	if s.pids > 0 {
+		limits["pids.max"] = strconv.FormatInt(s.pids, 10)
+		controllers = append(controllers, "pids")
+	}
+
+	if err := os.MkdirAll(s.cgroupRoot, 0755); err != nil {
+		return fmt.Errorf("creating sandbox cgroup: %w", err)
+	}
+	// Children only get the controllers their parent hands down
+	for _, controller := range controllers {
+		if err := writeCgroupFile(s.cgroupRoot, "cgroup.subtree_control", "+"+controller); err != nil {
+			return fmt.Errorf("enabling the %s controller for sandboxes (is it delegated to %s?): %w", controller, s.cgroupRoot, err)
+		}
+	}
+
+	cgroup := filepath.Join(s.cgroupRoot, "run-"+uuid.NewString())
+	if err := os.Mkdir(cgroup, 0755); err != nil {
+		return fmt.Errorf("creating sandbox cgroup: %w", err)
+	}
+	s.cgroup = cgroup
+	for file, value := range limits {
+		if err := writeCgroupFile(cgroup, file, value); err != nil {
+			s.stop()
+			return fmt.Errorf("limiting sandbox: %w", err)
+		}
+	}
+	// Don't let the run swap its way past the memory limit
+	if _, ok := limits["memory.max"]; ok {
+		_ = writeCgroupFile(cgroup, "memory.swap.max", "0")
+	}
+	return nil
+}
+
+// Kill anything left in the run's cgroup and remove it
+func (s *sandboxRun) stop() {
+	if s.cgroup == "" {
+		return
+	}
+	_ = writeCgroupFile(s.cgroup, "cgroup.kill", "1")
+	deadline := time.Now().Add(cgroupRemoveTimeout)
+	for {
+		err := os.Remove(s.cgroup)
+		if err == nil || errors.Is(err, os.ErrNotExist) || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	s.cgroup = ""
+}
+
+// How many times the kernel's OOM killer has killed something in the run's cgroup
+func (s *sandboxRun) oomKills() int64 {
+	if s == nil || s.cgroup == "" {
+		return 0
+	}
+	data, err := os.ReadFile(filepath.Join(s.cgroup, "memory.events"))
+	if err != nil {
+		return 0
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if strings.HasPrefix(line, "oom_kill ") {
+			n, _ := strconv.ParseInt(strings.TrimPrefix(line, "oom_kill "), 10, 64)
+			return n
+		}
+	}
+	return 0
+}
+
+// Run args through sandbox-exec in new namespaces. The user, group, and umask
+// are applied inside, after the mounts that need root have been made.
+func (s *sandboxRun) command(r *runEnv, args []string) *exec.Cmd {
+	argv := []string{SandboxExecCommand}
+	if s.cgroup != "" {
+		argv = append(argv, "--cgroup", s.cgroup)
+	}
+	if r.dir != "" {
+		argv = append(argv, "--workdir", r.dir)
+	}
+	for _, dir := range s.writable {
+		argv = append(argv, "--writable", dir)
+	}
+	if r.umask != "" {
+		argv = append(argv, "--umask", r.umask)
+	}
+	if r.cred != nil {
+		argv = append(argv, "--uid", strconv.Itoa(int(r.cred.Uid)), "--gid", strconv.Itoa(int(r.cred.Gid)))
+		for _, group := range r.cred.Groups {
+			argv = append(argv, "--groups", strconv.Itoa(int(group)))
+		}
+	}
+	argv = append(argv, "--")
+	argv = append(argv, args...)
+
+	cmd := exec.Command("/proc/self/exe", argv...)
+	// sandbox-exec starts out as root, so the action's environment is kept from
+	// it where variables like LD_PRELOAD could change what it does
+	env, _ := json.Marshal(r.env)
+	cmd.Env = []string{sandboxEnvVar + "=" + string(env)}
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Cloneflags: syscall.CLONE_NEWNS | syscall.CLONE_NEWPID | syscall.CLONE_NEWIPC | syscall.CLONE_NEWUTS,
+	}
+	if !s.network {
+		cmd.SysProcAttr.Cloneflags |= syscall.CLONE_NEWNET
+	}
+	return cmd
+}
+
+// Runs as pid 1 of the sandbox: join the cgroup, make everything but the writable
+// dirs read-only, then run the command and exit the way it did.
+func runSandboxExec(opts sandboxExecOptions, args []string) error {
+	var env []string
+	if err := json.Unmarshal([]byte(os.Getenv(sandboxEnvVar)), &env); err != nil {
+		return fmt.Errorf("reading the command's environment: %w", err)
+	}
+	os.Clearenv()
+	if opts.Cgroup != "" {
+		if err := writeCgroupFile(opts.Cgroup, "cgroup.procs", "0"); err != nil {
+			return fmt.Errorf("joining sandbox cgroup: %w", err)
+		}
+	}
+	workdir := opts.Workdir
+	if workdir == "" {
+		// Stay where the node is
+		var err error
+		if workdir, err = os.Getwd(); err != nil {
+			return err
+		}
+	}
+	if err := sandboxMounts(opts.Writable, workdir); err != nil {
+		return err
+	}
+	if err := os.Chdir(workdir); err != nil {
+		return err
+	}
+	if opts.Umask != "" {
+		mask, err := strconv.ParseUint(opts.Umask, 8, 32)
+		if err != nil {
+			return fmt.Errorf("invalid umask %q", opts.Umask)
+		}
+		syscall.Umask(int(mask))
+	}
+	// Capabilities belong to threads, so the command has to be started from the one that dropped them
+	runtime.LockOSThread()
+	if err := dropPrivileges(); err != nil {
+		return err
+	}
+
+	// Look the command up on the action's PATH
+	for _, kv := range env {
+		if strings.HasPrefix(kv, "PATH=") {
+			os.Setenv("PATH", strings.TrimPrefix(kv, "PATH="))
+		}
+	}
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Env = env
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if opts.Uid >= 0 {
+		cred := &syscall.Credential{Uid: uint32(opts.Uid), Gid: uint32(opts.Gid)}
+		for _, group := range opts.Groups {
+			cred.Groups = append(cred.Groups, uint32(group))
+		}
+		cmd.SysProcAttr = &syscall.SysProcAttr{Credential: cred}
+	}
+
+	// As pid 1 nothing is delivered without a handler, so pass signals on to the command
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP)
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	go func() {
+		for sig := range signals {
+			_ = cmd.Process.Signal(sig)
+		}
+	}()
+	err := cmd.Wait()
+
+	// Leaving takes the rest of the sandbox's processes with it
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		if status, ok := exitErr.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+			os.Exit(128 + int(status.Signal()))
+		}
+		os.Exit(exitErr.ExitCode())
+	}
+	if err != nil {
+		return err
+	}
+	os.Exit(0)
+	return nil
+}
+
+// Give the sandbox its own /proc, /dev and /tmp, and leave only the writable dirs writable
+func sandboxMounts(writable []string, workdir string) error {
+	// Keep everything below from leaking back to the node
+	if err := syscall.Mount("", "/", "", syscall.MS_REC|syscall.MS_PRIVATE, ""); err != nil {
+		return fmt.Errorf("making mounts private: %w", err)
+	}
+	// Bound onto themselves so they are separate mounts that stay writable
+	keep := []string{}
+	for _, dir := range writable {
+		dir, err := filepath.Abs(dir)
+		if err != nil {
+			return err
+		}
+		if err := syscall.Mount(dir, dir, "", syscall.MS_BIND|syscall.MS_REC, ""); err != nil {
+			return fmt.Errorf("binding writable dir %s: %w", dir, err)
+		}
+		keep = append(keep, dir)
+	}
+	if err := syscall.Mount("proc", "/proc", "proc", syscall.MS_NOSUID|syscall.MS_NODEV|syscall.MS_NOEXEC, ""); err != nil {
+		return fmt.Errorf("mounting /proc: %w", err)
+	}
+	if err := sandboxDev(); err != nil {
+		return err
+	}
+	// A fresh /tmp would hide the workdir or writable dirs inside the node's
+	if !isUnder("/tmp", keep) && !anyUnder(keep, "/tmp") && !isUnder(workdir, []string{"/tmp"}) {
+		if err := syscall.Mount("tmpfs", "/tmp", "tmpfs", syscall.MS_NOSUID|syscall.MS_NODEV, "mode=1777"); err != nil {
+			return fmt.Errorf("mounting /tmp: %w", err)
+		}
+		keep = append(keep, "/tmp")
+	}
+
+	mounts, err := mountPoints()
+	if err != nil {
+		return err
+	}
+	for _, mount := range mounts {
+		if isUnder(mount, keep) {
+			continue
+		}
+		var stat syscall.Statfs_t
+		if err := syscall.Statfs(mount, &stat); err != nil {
+			// Mount points that went away or can't be looked at can't be written either
+			continue
+		}
+		flags := uintptr(syscall.MS_REMOUNT | syscall.MS_BIND | syscall.MS_RDONLY)
+		// Remounting drops the flags that aren't given again
+		for st, ms := range map[int64]uintptr{
+			0x2:    syscall.MS_NOSUID,
+			0x4:    syscall.MS_NODEV,
+			0x8:    syscall.MS_NOEXEC,
+			0x400:  syscall.MS_NOATIME,
+			0x800:  syscall.MS_NODIRATIME,
+			0x1000: syscall.MS_RELATIME,
+		} {
+			if int64(stat.Flags)&st != 0 {
+				flags |= ms
+			}
+		}
+		if err := syscall.Mount("", mount, "", flags, ""); err != nil {
+			// Mounts hidden under another one can't be remounted by path, but can't be reached either
+			if mount == "/" {
+				return fmt.Errorf("making / read-only: %w", err)
+			}
+		}
+	}
+	return nil
+}
+
+// Replace /dev with one holding only the harmless devices, so the disks and
+// the like can't be opened even by root
+func sandboxDev() error {
+	if err := syscall.Mount("tmpfs", "/dev", "tmpfs", syscall.MS_NOSUID|syscall.MS_NOEXEC, "mode=755,size=64k"); err != nil {
+		return fmt.Errorf("mounting /dev: %w", err)
+	}
+	for name, dev := range sandboxDevices {
+		// The old encoding of device numbers covers these small majors and minors
+		if err := syscall.Mknod("/dev/"+name, syscall.S_IFCHR|0666, int(dev[0]<<8|dev[1])); err != nil {
+			return fmt.Errorf("creating /dev/%s: %w", name, err)
+		}
+		// mknod is subject to the umask
+		if err := os.Chmod("/dev/"+name, 0666); err != nil {
+			return err
+		}
+	}
+	for name, target := range map[string]string{
+		"fd":     "/proc/self/fd",
+		"stdin":  "/proc/self/fd/0",
+		"stdout": "/proc/self/fd/1",
+		"stderr": "/proc/self/fd/2",
+	} {
+		if err := os.Symlink(target, "/dev/"+name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Make sure the command can't get any capabilities, whatever user it runs as.
+// Root loses its special treatment at exec, and setuid or file capabilities
+// can't give anything back. This process keeps its own to switch users.
+func dropPrivileges() error {
+	if _, _, errno := syscall.RawSyscall6(syscall.SYS_PRCTL, prSetSecurebits, secbitNoroot|secbitNorootLocked, 0, 0, 0, 0); errno != 0 {
+		return fmt.Errorf("setting securebits: %w", errno)
+	}
+	// Ambient capabilities are new in Linux 4.3; older kernels don't have any to clear
+	if _, _, errno := syscall.RawSyscall6(syscall.SYS_PRCTL, prCapAmbient, prCapAmbientClear, 0, 0, 0, 0); errno != 0 && errno != syscall.EINVAL {
+		return fmt.Errorf("clearing ambient capabilities: %w", errno)
+	}
+
+	header := struct {
+		version uint32
+		pid     int32
+	}{version: capabilityVersion3}
+	var data [2]struct {
+		effective   uint32
+		permitted   uint32
+		inheritable uint32
+	}
+	if _, _, errno := syscall.RawSyscall(syscall.SYS_CAPGET, uintptr(unsafe.Pointer(&header)), uintptr(unsafe.Pointer(&data[0])), 0); errno != 0 {
+		return fmt.Errorf("reading capabilities: %w", errno)
+	}
+	data[0].inheritable, data[1].inheritable = 0, 0
+	if _, _, errno := syscall.RawSyscall(syscall.SYS_CAPSET, uintptr(unsafe.Pointer(&header)), uintptr(unsafe.Pointer(&data[0])), 0); errno != 0 {
+		return fmt.Errorf("clearing inheritable capabilities: %w", errno)
+	}
+
+	last := 63
+	if data, err := os.ReadFile("/proc/sys/kernel/cap_last_cap"); err == nil {
+		if n, err := strconv.Atoi(strings.TrimSpace(string(data))); err == nil {
+			last = n
+		}
+	}
+	for capability := 0; capability <= last; capability++ {
+		if _, _, errno := syscall.RawSyscall6(syscall.SYS_PRCTL, prCapbsetDrop, uintptr(capability), 0, 0, 0, 0); errno != 0 && errno != syscall.EINVAL {
+			return fmt.Errorf("dropping capability %d: %w", capability, errno)
+		}
+	}
+
+	if _, _, errno := syscall.RawSyscall6(syscall.SYS_PRCTL, prSetNoNewPrivs, 1, 0, 0, 0, 0); errno != 0 {
+		return fmt.Errorf("setting no_new_privs: %w", errno)
+	}
+	return nil
+}
+
+// Every mount point in the sandbox's mount namespace
+func mountPoints() ([]string, error) {
+	f, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	mounts := []string{}
+	seen := map[string]bool{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// 36 35 98:0 /mnt1 /mnt2 rw,noatime master:1 - ext3 /dev/root rw,errors=continue
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 5 {
+			continue
+		}
+		mount := unescapeMountPath(fields[4])
+		if !seen[mount] {
+			seen[mount] = true
+			mounts = append(mounts, mount)
+		}
+	}
+	return mounts, scanner.Err()
+}
+
+// Mount paths escape spaces and the like as \040
+func unescapeMountPath(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+3 < len(s) {
+			if n, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(n))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+// Whether path is one of dirs or inside one of them
+func isUnder(path string, dirs []string) bool {
+	for _, dir := range dirs {
+		if path == dir || strings.HasPrefix(path, strings.TrimSuffix(dir, "/")+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// Whether any of dirs is inside dir
+func anyUnder(dirs []string, dir string) bool {
+	for _, d := range dirs {
+		if isUnder(d, []string{dir}) {
+			return true
+		}
+	}
+	return false
+}
+
+func writeCgroupFile(cgroup string, file string, value string) error {
+	return os.WriteFile(filepath.Join(cgroup, file), []byte(value), 0644)
+}
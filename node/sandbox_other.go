@@ -0,0 +1,31 @@
+//go:build !linux
+
+package node
+
+import (
+	"fmt"
+	"os/exec"
+	"runtime"
+
+	"github.com/bofrim/gorch/node/resources"
+)
+
+var errSandboxUnsupported = fmt.Errorf("sandboxed actions aren't supported on %s", runtime.GOOS)
+
+func (s *sandboxRun) start(req resources.ResourceRequest) error {
+	return errSandboxUnsupported
+}
+
+func (s *sandboxRun) stop() {}
+
+func (s *sandboxRun) oomKills() int64 {
+	return 0
+}
+
+func (s *sandboxRun) command(r *runEnv, args []string) *exec.Cmd {
+	return exec.Command(args[0], args[1:]...)
+}
+
+func runSandboxExec(opts sandboxExecOptions, args []string) error {
+	return errSandboxUnsupported
+}
@@ -0,0 +1,62 @@
+package node
+
+import (
+	"bytes"
+	"sync"
+)
+
+// Output is forwarded in pieces of at most this many bytes when a line is too long
+const MaxOutputChunk = 4096
+
+// Receives output from an action as it is produced
+type OutputFunc func(stream string, command int, data []byte)
+
+// An io.Writer that hands whatever is written to it to an OutputFunc one line at a time
+type lineWriter struct {
+	mu      sync.Mutex
+	buf     []byte
+	stream  string
+	command int
+	output  OutputFunc
+}
+
+func newLineWriter(stream string, command int, output OutputFunc) *lineWriter {
+	return &lineWriter{
+		stream:  stream,
+		command: command,
+		output:  output,
+	}
+}
+
+func (w *lineWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.buf = append(w.buf, p...)
+	for {
+		i := bytes.IndexByte(w.buf, '\n')
+		if i < 0 {
+			break
+		}
+		w.emit(w.buf[:i+1])
+		w.buf = w.buf[i+1:]
+	}
+	for len(w.buf) >= MaxOutputChunk {
+		w.emit(w.buf[:MaxOutputChunk])
+		w.buf = w.buf[MaxOutputChunk:]
+	}
+	return len(p), nil
+}
+
+// Send whatever is left over, even if it isn't a full line
+func (w *lineWriter) Flush() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if len(w.buf) > 0 {
+		w.emit(w.buf)
+		w.buf = nil
+	}
+}
+
+func (w *lineWriter) emit(data []byte) {
+	w.output(w.stream, w.command, append([]byte{}, data...))
+}
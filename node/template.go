@@ -0,0 +1,429 @@
+package node
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"text/template"
+	"text/template/parse"
+	"time"
+)
+
+// The functions available to action commands
+var templateFuncs = template.FuncMap{
+	"shellquote": shellQuote,
+	"default":    defaultValue,
+	"upper":      strings.ToUpper,
+	"lower":      strings.ToLower,
+	"join":       join,
+	"env":        os.Getenv,
+	"now":        time.Now,
+	"json":       toJSON,
+	"base64":     toBase64,
+}
+
+// Quote a value so a POSIX shell reads it as a single word, as is
+func shellQuote(v any) string {
+	return "'" + strings.ReplaceAll(fmt.Sprint(v), "'", `'\''`) + "'"
+}
+
+// The value, or def when it is empty: {{ .name | default "world" }}
+func defaultValue(def any, v any) any {
+	if v == nil {
+		return def
+	}
+	if rv := reflect.ValueOf(v); rv.IsZero() {
+		return def
+	}
+	return v
+}
+
+// Join values with sep. A single list is joined item by item: {{ join "," .a .b }} or {{ .list | join "," }}
+func join(sep string, items ...any) string {
+	if len(items) == 1 {
+		if rv := reflect.ValueOf(items[0]); rv.Kind() == reflect.Slice || rv.Kind() == reflect.Array {
+			items = make([]any, rv.Len())
+			for i := range items {
+				items[i] = rv.Index(i).Interface()
+			}
+		}
+	}
+	parts := make([]string, len(items))
+	for i, item := range items {
+		parts[i] = fmt.Sprint(item)
+	}
+	return strings.Join(parts, sep)
+}
+
+func toJSON(v any) (string, error) {
+	var b strings.Builder
+	enc := json.NewEncoder(&b)
+	// Leave characters like & alone; this isn't going into HTML
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(v); err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(b.String(), "\n"), nil
+}
+
+func toBase64(v any) string {
+	return base64.StdEncoding.EncodeToString([]byte(fmt.Sprint(v)))
+}
+
+// Render text with the action's params. Referring to a param that wasn't given is an error.
+func renderTemplate(name string, text string, params any) (string, error) {
+	t, err := template.New(name).Funcs(templateFuncs).Option("missingkey=error").Parse(text)
+	if err != nil {
+		return "", err
+	}
+
+	var b strings.Builder
+	if err := t.Execute(&b, params); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
+
+// Marks where a {{ }} was in a rendered command. NUL can't be part of a real argument.
+const argMarker = "\x00"
+
+var argMarkerPattern = regexp.MustCompile(argMarker + `(\d+)` + argMarker)
+
+// Render a command with the output of every {{ }} kept apart from the command's
+// own text. Each one is left in the text as a marker for values[i], except those
+// using an unsafe param, which are pasted in as they are.
+func renderCommand(name string, text string, params any, unsafe map[string]bool) (string, []string, error) {
+	values := []string{}
+	funcs := template.FuncMap{
+		"gorchArg": func(v any) string {
+			values = append(values, fmt.Sprint(v))
+			return fmt.Sprintf("%s%d%s", argMarker, len(values)-1, argMarker)
+		},
+		// The value is kept out of the command's text, so there is nothing left to quote
+		"gorchKeep": func(v any) any { return v },
+	}
+	t, err := template.New(name).Funcs(templateFuncs).Funcs(funcs).Option("missingkey=error").Parse(text)
+	if err != nil {
+		return "", nil, err
+	}
+	for _, tmpl := range t.Templates() {
+		if tmpl.Tree != nil {
+			markActions(tmpl.Tree, tmpl.Tree.Root, unsafe)
+		}
+	}
+
+	var b strings.Builder
+	if err := t.Execute(&b, params); err != nil {
+		return "", nil, err
+	}
+	return b.String(), values, nil
+}
+
+// Send the output of every action in the list that prints something through gorchArg
+func markActions(tree *parse.Tree, list *parse.ListNode, unsafe map[string]bool) {
+	if list == nil {
+		return
+	}
+	for _, node := range list.Nodes {
+		switch node := node.(type) {
+		case *parse.ActionNode:
+			pipe := node.Pipe
+			if len(pipe.Decl) > 0 || usesParam(pipe, unsafe) {
+				continue
+			}
+			keepShellQuotes(pipe)
+			last := pipe.Cmds[len(pipe.Cmds)-1]
+			pipe.Cmds = append(pipe.Cmds, &parse.CommandNode{
+				NodeType: parse.NodeCommand,
+				Pos:      last.Pos,
+				Args:     []parse.Node{parse.NewIdentifier("gorchArg").SetTree(tree)},
+			})
+		case *parse.IfNode:
+			markActions(tree, node.List, unsafe)
+			markActions(tree, node.ElseList, unsafe)
+		case *parse.RangeNode:
+			markActions(tree, node.List, unsafe)
+			markActions(tree, node.ElseList, unsafe)
+		case *parse.WithNode:
+			markActions(tree, node.List, unsafe)
+			markActions(tree, node.ElseList, unsafe)
+		}
+	}
+}
+
+// Turn shellquote into a no-op anywhere in the pipeline, so values that are
+// passed on their own don't end up with literal quotes
+func keepShellQuotes(pipe *parse.PipeNode) {
+	for _, cmd := range pipe.Cmds {
+		for _, arg := range cmd.Args {
+			switch arg := arg.(type) {
+			case *parse.IdentifierNode:
+				if arg.Ident == "shellquote" {
+					arg.Ident = "gorchKeep"
+				}
+			case *parse.PipeNode:
+				keepShellQuotes(arg)
+			}
+		}
+	}
+}
+
+// Where in a shell script a character is
+type shellContext int
+
+const (
+	shellCode shellContext = iota
+	shellSingle
+	shellDouble
+	shellComment
+	// Command substitution with backticks
+	shellBackticks
+	// Arithmetic expansion, $(( ))
+	shellArithmetic
+)
+
+// A context the script is inside of, with the parentheses opened within it
+type shellFrame struct {
+	context shellContext
+	parens  int
+}
+
+// Swap the count markers in a shell script for references to the positional
+// parameters ${1}, ${2}, ..., quoted to suit where each marker is. The values
+// reach the shell as separate arguments and are never parsed as part of the script.
+// Quotes, comments and $( ) are followed so that each marker is quoted for the
+// context it ends up in. Backticks and $(( )) would parse the value again, so
+// markers aren't allowed inside them.
+func shellScript(text string, count int) (string, error) {
+	stack := []shellFrame{{context: shellCode}}
+	push := func(context shellContext) { stack = append(stack, shellFrame{context: context}) }
+	pop := func() {
+		if len(stack) > 1 {
+			stack = stack[:len(stack)-1]
+		}
+	}
+
+	var b strings.Builder
+	for i := 0; i < len(text); i++ {
+		c := text[i]
+		top := &stack[len(stack)-1]
+		if c == argMarker[0] {
+			loc := argMarkerPattern.FindStringSubmatchIndex(text[i:])
+			if loc == nil || loc[0] != 0 {
+				return "", fmt.Errorf("commands can't contain NUL bytes")
+			}
+			n, _ := strconv.Atoi(text[i+loc[2] : i+loc[3]])
+			if n >= count {
+				return "", fmt.Errorf("commands can't contain NUL bytes")
+			}
+			for _, frame := range stack {
+				switch frame.context {
+				case shellBackticks:
+					return "", fmt.Errorf("a template can't be inside backticks; use $( ) instead")
+				case shellArithmetic:
+					return "", fmt.Errorf("a template can't be inside $(( ))")
+				}
+			}
+			ref := fmt.Sprintf("${%d}", n+1)
+			switch top.context {
+			case shellCode:
+				b.WriteString(`"` + ref + `"`)
+			case shellDouble, shellComment:
+				b.WriteString(ref)
+			case shellSingle:
+				b.WriteString(`'"` + ref + `"'`)
+			}
+			i += loc[1] - 1
+			continue
+		}
+
+		switch top.context {
+		case shellSingle:
+			if c == '\'' {
+				pop()
+			}
+			b.WriteByte(c)
+			continue
+		case shellComment:
+			if c == '\n' {
+				pop()
+			}
+			b.WriteByte(c)
+			continue
+		}
+
+		// Code, double quotes and substitutions from here on
+		switch {
+		case c == '\\':
+			if strings.HasPrefix(text[i+1:], argMarker) {
+				return "", fmt.Errorf("a template can't follow a backslash")
+			}
+			b.WriteByte(c)
+			if i+1 < len(text) {
+				i++
+				b.WriteByte(text[i])
+			}
+			continue
+		case strings.HasPrefix(text[i:], "$(("):
+			push(shellArithmetic)
+			b.WriteString("$((")
+			i += 2
+			continue
+		case strings.HasPrefix(text[i:], "$("):
+			push(shellCode)
+			b.WriteString("$(")
+			i++
+			continue
+		case c == '`' && top.context == shellBackticks:
+			pop()
+		case c == '`':
+			push(shellBackticks)
+		case c == '"' && top.context == shellDouble:
+			pop()
+		case top.context == shellDouble:
+		case c == '"':
+			push(shellDouble)
+		case c == '\'':
+			push(shellSingle)
+		case c == '#' && (i == 0 || strings.IndexByte(" \t\n;&|()<>", text[i-1]) >= 0):
+			push(shellComment)
+		case c == '(':
+			top.parens++
+		case c == ')' && top.parens > 0:
+			top.parens--
+		case c == ')' && top.context == shellArithmetic:
+			pop()
+			if strings.HasPrefix(text[i+1:], ")") {
+				b.WriteString("))")
+				i++
+				continue
+			}
+		case c == ')' && top.context == shellCode:
+			pop()
+		}
+		b.WriteByte(c)
+	}
+	return b.String(), nil
+}
+
+// Split a command without a shell into arguments, then put the values back in
+// place of their markers. Values never split into more arguments.
+func commandArgs(text string, values []string) ([]string, error) {
+	words, err := splitWords(text)
+	if err != nil {
+		return nil, err
+	}
+	for i, word := range words {
+		if !strings.Contains(word, argMarker) {
+			continue
+		}
+		// Markers split the word into text, index, text, index, ..., text
+		parts := strings.Split(word, argMarker)
+		var b strings.Builder
+		for j, part := range parts {
+			if j%2 == 0 {
+				b.WriteString(part)
+				continue
+			}
+			n, err := strconv.Atoi(part)
+			if err != nil || n >= len(values) || j == len(parts)-1 {
+				return nil, fmt.Errorf("commands can't contain NUL bytes")
+			}
+			b.WriteString(values[n])
+		}
+		words[i] = b.String()
+	}
+	return words, nil
+}
+
+// Whether the pipeline refers to any of the named params, as .name or $.name
+func usesParam(pipe *parse.PipeNode, names map[string]bool) bool {
+	if pipe == nil {
+		return false
+	}
+	for _, cmd := range pipe.Cmds {
+		for _, arg := range cmd.Args {
+			switch arg := arg.(type) {
+			case *parse.FieldNode:
+				if names[arg.Ident[0]] {
+					return true
+				}
+			case *parse.VariableNode:
+				if len(arg.Ident) > 1 && arg.Ident[0] == "$" && names[arg.Ident[1]] {
+					return true
+				}
+			case *parse.ChainNode:
+				if p, ok := arg.Node.(*parse.PipeNode); ok && usesParam(p, names) {
+					return true
+				}
+			case *parse.PipeNode:
+				if usesParam(arg, names) {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// Split a command line into words the way a POSIX shell would, honouring
+// quotes and backslashes but without expanding anything
+func splitWords(s string) ([]string, error) {
+	words := []string{}
+	var word strings.Builder
+	inWord := false
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n':
+			if inWord {
+				words = append(words, word.String())
+				word.Reset()
+				inWord = false
+			}
+		case c == '\'':
+			end := strings.IndexByte(s[i+1:], '\'')
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated ' in %q", s)
+			}
+			word.WriteString(s[i+1 : i+1+end])
+			i += end + 1
+			inWord = true
+		case c == '"':
+			closed := false
+			for i++; i < len(s); i++ {
+				if s[i] == '"' {
+					closed = true
+					break
+				}
+				// Inside double quotes a backslash only escapes these
+				if s[i] == '\\' && i+1 < len(s) && strings.IndexByte("\"\\$`", s[i+1]) >= 0 {
+					i++
+				}
+				word.WriteByte(s[i])
+			}
+			if !closed {
+				return nil, fmt.Errorf("unterminated \" in %q", s)
+			}
+			inWord = true
+		case c == '\\':
+			if i+1 < len(s) {
+				i++
+				word.WriteByte(s[i])
+			}
+			inWord = true
+		default:
+			word.WriteByte(c)
+			inWord = true
+		}
+	}
+	if inWord {
+		words = append(words, word.String())
+	}
+	return words, nil
+}
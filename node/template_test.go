@@ -0,0 +1,144 @@
+package node
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// Values that would run something or change the command if they were part of a script
+var hostileValues = []string{
+	`x"; touch PWNED; echo "`,
+	`x'; touch PWNED; echo '`,
+	`$(touch PWNED)`,
+	"`touch PWNED`",
+	`; touch PWNED`,
+	`&& touch PWNED`,
+	`| touch PWNED`,
+	`> PWNED`,
+	"a\ntouch PWNED",
+	`\`,
+	`\"; touch PWNED; echo \"`,
+	`${IFS}touch${IFS}PWNED`,
+	`*`,
+	`-n`,
+	``,
+}
+
+func TestShellCommandsKeepValuesOutOfTheScript(t *testing.T) {
+	commands := map[string]string{
+		"bare":                `printf %s {{.v}}`,
+		"double quoted":       `printf %s "{{.v}}"`,
+		"single quoted":       `printf %s '{{.v}}'`,
+		"shellquote":          `printf %s {{.v | shellquote}}`,
+		"joined":              `printf %s "<"{{.v}}'>'`,
+		"conditional":         `{{if .v}}printf %s {{.v}}{{else}}printf %s ''{{end}}`,
+		"substitution":        `printf %s "$(printf '%s|' "{{.v}}")"`,
+		"bare substitution":   `printf %s "$(printf %s {{.v}})"`,
+		"nested substitution": `printf %s "$(printf %s "$(printf %s '{{.v}}')")"`,
+		"subshell":            `(printf %s {{.v}})`,
+		"after arithmetic":    `printf %s "$((1+(2)))" {{.v}}`,
+		"after a comment":     "# it's {{.v}}\nprintf %s {{.v}} # \"",
+	}
+	want := map[string]func(string) string{
+		"joined":           func(v string) string { return "<" + v + ">" },
+		"substitution":     func(v string) string { return v + "|" },
+		"after arithmetic": func(v string) string { return "3" + v },
+	}
+
+	for name, command := range commands {
+		for _, value := range hostileValues {
+			dir := t.TempDir()
+			action := Action{Name: "test", Shell: "/bin/sh", Commands: []Command{{Run: command}}}
+			argvs, err := action.BuildCommands(map[string]string{"v": value})
+			if err != nil {
+				t.Fatalf("%s %q: %s", name, value, err)
+			}
+			cmd := exec.Command(argvs[0][0], argvs[0][1:]...)
+			cmd.Dir = dir
+			out, err := cmd.Output()
+			if err != nil {
+				t.Fatalf("%s %q: %s", name, value, err)
+			}
+			expected := value
+			if f, ok := want[name]; ok {
+				expected = f(value)
+			}
+			if string(out) != expected {
+				t.Errorf("%s %q: got %q", name, value, out)
+			}
+			if _, err := os.Stat(filepath.Join(dir, "PWNED")); err == nil {
+				t.Errorf("%s %q: the value ran a command", name, value)
+			}
+			if strings.Contains(argvs[0][2], value) && value != "" && value != "*" && value != "-n" {
+				t.Errorf("%s %q: the value is part of the script %q", name, value, argvs[0][2])
+			}
+		}
+	}
+}
+
+func TestCommandsWithoutShell(t *testing.T) {
+	tests := []struct {
+		run    string
+		params map[string]string
+		want   []string
+	}{
+		{`echo "hello {{.v}}"`, map[string]string{"v": "world"}, []string{"echo", "hello world"}},
+		{`echo 'hello {{.v}}'`, map[string]string{"v": "world"}, []string{"echo", "hello world"}},
+		{`echo {{.v}}`, map[string]string{"v": "a b; c"}, []string{"echo", "a b; c"}},
+		{`echo {{.v}}`, map[string]string{"v": `"'`}, []string{"echo", `"'`}},
+		{`echo {{.v | shellquote | upper}}`, map[string]string{"v": "it's"}, []string{"echo", "IT'S"}},
+		{`echo x{{.a}}y{{.b}}z`, map[string]string{"a": "1 2", "b": "3"}, []string{"echo", "x1 2y3z"}},
+		{`echo {{$v := .v}}{{$v}}`, map[string]string{"v": "a b"}, []string{"echo", "a b"}},
+	}
+	for _, test := range tests {
+		action := Action{Name: "test", Commands: []Command{{Run: test.run}}}
+		argvs, err := action.BuildCommands(test.params)
+		if err != nil {
+			t.Fatalf("%s: %s", test.run, err)
+		}
+		if !reflect.DeepEqual(argvs[0], test.want) {
+			t.Errorf("%s: got %q, want %q", test.run, argvs[0], test.want)
+		}
+	}
+}
+
+func TestUnsafeParamsArePastedIn(t *testing.T) {
+	action := Action{
+		Name:     "test",
+		Shell:    "/bin/sh",
+		Params:   Params{{Name: "flags", Unsafe: true}, {Name: "v"}},
+		Commands: []Command{{Run: `printf '%s|' {{.flags}} {{.v}}`}},
+	}
+	argvs, err := action.BuildCommands(map[string]string{"flags": "-a -b", "v": "c d"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := exec.Command(argvs[0][0], argvs[0][1:]...).Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out) != "-a|-b|c d|" {
+		t.Errorf("got %q", out)
+	}
+}
+
+func TestTemplatesTheShellWouldParseAgain(t *testing.T) {
+	commands := []string{
+		`echo \{{.v}}`,
+		"echo `printf %s {{.v}}`",
+		"echo \"`printf %s \"{{.v}}\"`\"",
+		"echo $(echo `printf %s {{.v}}`)",
+		`echo $(( {{.v}} + 1 ))`,
+		`echo "$(( 1 + {{.v}} ))"`,
+	}
+	for _, command := range commands {
+		action := Action{Name: "test", Shell: "/bin/sh", Commands: []Command{{Run: command}}}
+		if _, err := action.BuildCommands(map[string]string{"v": "x"}); err == nil {
+			t.Errorf("%s: expected an error", command)
+		}
+	}
+}
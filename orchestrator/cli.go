@@ -28,6 +28,16 @@ func GetCliCommand() *cli.Command {
 				Usage:    "Specify a path to a file to log to. If not specified, logs will be printed to stdout",
 				Required: false,
 			},
+			&cli.DurationFlag{
+				Name:  "proxy-timeout",
+				Usage: "How long to wait for a node to start answering a request forwarded to it.",
+				Value: DefaultProxyTimeout,
+			},
+			&cli.StringFlag{
+				Name:     "state-dir",
+				Usage:    "Specify a directory to keep the registered nodes and their history in across restarts.",
+				Required: false,
+			},
 			&cli.StringFlag{
 				Name:     "cert-path",
 				Usage:    "Specify a path with ssl.crt and ssl.key files",
@@ -37,9 +47,11 @@ func GetCliCommand() *cli.Command {
 		Action: func(cCtx *cli.Context) error {
 			fmt.Println("Gorch orchestrator running on port: ", cCtx.Int("port"))
 			orchestrator := Orchestrator{
-				Port:     cCtx.Int("port"),
-				LogFile:  cCtx.String("log"),
-				CertPath: cCtx.String("cert-path"),
+				Port:         cCtx.Int("port"),
+				LogFile:      cCtx.String("log"),
+				CertPath:     cCtx.String("cert-path"),
+				ProxyTimeout: cCtx.Duration("proxy-timeout"),
+				StateDir:     cCtx.String("state-dir"),
 			}
 			return orchestrator.Run()
 		},
@@ -9,31 +9,42 @@ import (
 
 const DisconnectStaleNodePeriod = 10 * time.Second
 
+// How long nodes restored from the store get to check in before they are forgotten
+const ForgetUnknownNodePeriod = 24 * time.Hour
+
 type NodeConnection struct {
-	Name            string    `json:"name"`
-	Address         string    `json:"address"`
-	Port            int       `json:"port"`
-	LastInteraction time.Time `json:"last_interaction"`
+	Name            string            `json:"name"`
+	Address         string            `json:"address"`
+	Port            int               `json:"port"`
+	Labels          map[string]string `json:"labels,omitempty"`
+	Status          string            `json:"status"`
+	LastInteraction time.Time         `json:"last_interaction"`
 }
 
 func DisconnectThread(orchestrator *Orchestrator, ctx context.Context, logger *slog.Logger, done func()) {
+	defer done()
 	ticker := time.NewTicker(DisconnectStaleNodePeriod)
+	defer ticker.Stop()
 	for {
 		select {
 		case <-ticker.C:
-			// Kick any nodes that we haven't heard from in the last DisconnectStaleNodePeriod
-			for name, n := range orchestrator.Nodes {
-				if n.LastInteraction.Before(time.Now().Add(-1 * DisconnectStaleNodePeriod)) {
-					delete(orchestrator.Nodes, name)
-					logger.Info("Stale node.",
-						slog.String("node", name),
-						slog.Int("num_nodes", len(orchestrator.Nodes)),
-					)
-				}
+			// Kick any nodes that we haven't heard from in the last DisconnectStaleNodePeriod,
+			// and forget restored ones that never came back
+			dropped := orchestrator.dropStale(time.Now())
+			for _, n := range dropped {
+				orchestrator.proxy.Drop(n.Name)
+				logger.Info("Stale node.",
+					slog.String("node", n.Name),
+					slog.String("status", n.Status),
+				)
+			}
+			if len(dropped) > 0 {
+				orchestrator.saveNodes()
 			}
 		case <-ctx.Done():
+			// Leave the last seen times on disk as fresh as they can be
+			orchestrator.saveNodes()
 			return
 		}
 	}
-
 }
@@ -0,0 +1,392 @@
+package orchestrator
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bofrim/gorch/hook"
+	"golang.org/x/exp/slog"
+)
+
+// Number of nodes an action is run on at once unless told otherwise
+const DefaultFleetConcurrency = 10
+
+// Outcomes of running an action on one node of a fleet
+const (
+	FleetSucceeded   = "succeeded"
+	FleetFailed      = "failed"
+	FleetUnreachable = "unreachable"
+)
+
+// Server-sent event carrying the result of a single node
+const FleetResultEvent = "result"
+
+// Server-sent event sent as each batch of a rolling fleet action starts
+const FleetBatchEvent = "batch"
+
+// Allow any number of failures
+const UnlimitedFailures = -1
+
+// An action to run on many nodes
+type FleetRequest struct {
+	Action      string
+	Params      map[string]interface{}
+	Headers     http.Header
+	Concurrency int
+	// Nodes to run on before the rest. Any failure among them stops the run.
+	Canary int
+	// Nodes per batch after the canaries. 0 runs the rest in one batch.
+	BatchSize int
+	// Stop before the next batch once more nodes than this have failed
+	MaxFailures int
+	// Time to wait between batches
+	BatchPause time.Duration
+}
+
+// Whether the nodes are run in batches rather than all at once
+func (r *FleetRequest) rolling() bool {
+	return r.Canary > 0 || r.BatchSize > 0
+}
+
+// Split the targets into the batches they will be run in
+func (r *FleetRequest) batches(targets []string) [][]string {
+	if !r.rolling() {
+		return [][]string{targets}
+	}
+	batches := [][]string{}
+	rest := targets
+	if r.Canary > 0 {
+		n := minInt(r.Canary, len(rest))
+		batches = append(batches, rest[:n])
+		rest = rest[n:]
+	}
+	size := r.BatchSize
+	if size <= 0 {
+		size = len(rest)
+	}
+	for len(rest) > 0 {
+		n := minInt(size, len(rest))
+		batches = append(batches, rest[:n])
+		rest = rest[n:]
+	}
+	return batches
+}
+
+type FleetNodeResult struct {
+	Node      string          `json:"node"`
+	Outcome   string          `json:"outcome"`
+	ExitCodes []int           `json:"exit_codes"`
+	Error     string          `json:"error,omitempty"`
+	Job       json.RawMessage `json:"job,omitempty"`
+}
+
+type FleetReport struct {
+	Action      string                      `json:"action"`
+	Succeeded   []string                    `json:"succeeded"`
+	Failed      []string                    `json:"failed"`
+	Unreachable []string                    `json:"unreachable"`
+	Skipped     []string                    `json:"skipped"`
+	Batches     [][]string                  `json:"batches"`
+	Aborted     bool                        `json:"aborted"`
+	AbortReason string                      `json:"abort_reason,omitempty"`
+	Results     map[string]*FleetNodeResult `json:"results"`
+}
+
+// Sent as each batch of a rolling fleet action starts
+type FleetBatch struct {
+	Batch int      `json:"batch"`
+	Of    int      `json:"of"`
+	Nodes []string `json:"nodes"`
+}
+
+// Output from one of the nodes running a fleet action
+type FleetUpdate struct {
+	Node   string      `json:"node"`
+	Update hook.Update `json:"update"`
+}
+
+// Receives updates and per node results as a fleet action runs. Never called concurrently.
+type FleetEmitter func(event string, payload any)
+
+// The parts of a node's job the orchestrator cares about
+type nodeJob struct {
+	ID        string `json:"id"`
+	Status    string `json:"status"`
+	ExitCodes []int  `json:"exit_codes"`
+	Error     string `json:"error"`
+}
+
+func NewFleetReport(action string) *FleetReport {
+	return &FleetReport{
+		Action:      action,
+		Succeeded:   []string{},
+		Failed:      []string{},
+		Unreachable: []string{},
+		Skipped:     []string{},
+		Batches:     [][]string{},
+		Results:     map[string]*FleetNodeResult{},
+	}
+}
+
+func (r *FleetReport) add(result *FleetNodeResult) {
+	r.Results[result.Node] = result
+	switch result.Outcome {
+	case FleetSucceeded:
+		r.Succeeded = append(r.Succeeded, result.Node)
+		sort.Strings(r.Succeeded)
+	case FleetFailed:
+		r.Failed = append(r.Failed, result.Node)
+		sort.Strings(r.Failed)
+	default:
+		r.Unreachable = append(r.Unreachable, result.Node)
+		sort.Strings(r.Unreachable)
+	}
+}
+
+// Number of nodes where the action failed or couldn't be run
+func (r *FleetReport) failures() int {
+	return len(r.Failed) + len(r.Unreachable)
+}
+
+// Stop the run, leaving the remaining batches untouched
+func (r *FleetReport) abort(remaining [][]string, reason string) {
+	r.Aborted = true
+	r.AbortReason = reason
+	for _, batch := range remaining {
+		r.Skipped = append(r.Skipped, batch...)
+	}
+	sort.Strings(r.Skipped)
+}
+
+// Work out which nodes a fleet request is aimed at. Nodes that were named but
+// aren't registered are still returned so they can be reported as unreachable.
+func (o *Orchestrator) fleetTargets(names []string, selector Selector) []string {
+	targets := []string{}
+	if len(names) == 0 {
+		for name := range o.SelectNodes(selector) {
+			targets = append(targets, name)
+		}
+	} else {
+		for _, name := range names {
+			if conn, ok := o.GetNode(name); ok && !selector.Matches(conn.Labels) {
+				continue
+			}
+			targets = append(targets, name)
+		}
+	}
+	sort.Strings(targets)
+	return targets
+}
+
+// Run an action on every target node, at most req.Concurrency at a time.
+// Rolling requests go batch by batch and stop early once too many nodes fail.
+func (o *Orchestrator) RunFleet(ctx context.Context, targets []string, req *FleetRequest, emit FleetEmitter, logger *slog.Logger) *FleetReport {
+	report := NewFleetReport(req.Action)
+
+	// Serialize everything that goes back to the caller
+	var emitMu sync.Mutex
+	safeEmit := func(event string, payload any) {
+		emitMu.Lock()
+		defer emitMu.Unlock()
+		if emit != nil {
+			emit(event, payload)
+		}
+	}
+
+	batches := req.batches(targets)
+	for i, batch := range batches {
+		if i > 0 && req.BatchPause > 0 {
+			select {
+			case <-time.After(req.BatchPause):
+			case <-ctx.Done():
+			}
+		}
+		if ctx.Err() != nil {
+			report.abort(batches[i:], "the run was interrupted")
+			break
+		}
+
+		if req.rolling() {
+			logger.Info("Starting fleet batch.",
+				slog.String("action", req.Action),
+				slog.Int("batch", i+1),
+				slog.Int("of", len(batches)),
+				slog.Any("nodes", batch),
+			)
+			safeEmit(FleetBatchEvent, FleetBatch{Batch: i + 1, Of: len(batches), Nodes: batch})
+		}
+		report.Batches = append(report.Batches, batch)
+		o.runBatch(ctx, batch, req, report, safeEmit, &emitMu, logger)
+
+		if i == len(batches)-1 {
+			break
+		}
+		if req.Canary > 0 && i == 0 && report.failures() > 0 {
+			report.abort(batches[i+1:], fmt.Sprintf("%d of %d canary nodes failed", report.failures(), len(batch)))
+			break
+		}
+		if req.MaxFailures != UnlimitedFailures && report.failures() > req.MaxFailures {
+			report.abort(batches[i+1:], fmt.Sprintf("%d nodes failed, more than the %d allowed", report.failures(), req.MaxFailures))
+			break
+		}
+	}
+	if report.Aborted {
+		logger.Warn("Fleet action aborted.",
+			slog.String("action", req.Action),
+			slog.String("reason", report.AbortReason),
+			slog.Any("skipped", report.Skipped),
+		)
+	}
+	return report
+}
+
+// Run the action on one batch of nodes, at most req.Concurrency at a time
+func (o *Orchestrator) runBatch(ctx context.Context, batch []string, req *FleetRequest, report *FleetReport, emit FleetEmitter, reportMu *sync.Mutex, logger *slog.Logger) {
+	concurrency := req.Concurrency
+	if concurrency <= 0 {
+		concurrency = DefaultFleetConcurrency
+	}
+
+	slots := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	for _, name := range batch {
+		name := name
+		wg.Add(1)
+		slots <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-slots }()
+			result := o.dispatchAction(ctx, name, req, emit, logger)
+			emit(FleetResultEvent, result)
+			reportMu.Lock()
+			report.add(result)
+			reportMu.Unlock()
+		}()
+	}
+	wg.Wait()
+}
+
+// Start the action on a node in the background, follow its output, and collect the finished job
+func (o *Orchestrator) dispatchAction(ctx context.Context, name string, req *FleetRequest, emit FleetEmitter, logger *slog.Logger) *FleetNodeResult {
+	result := &FleetNodeResult{Node: name, ExitCodes: []int{}}
+	fail := func(outcome string, err error) *FleetNodeResult {
+		logger.Warn("Fleet action did not succeed on node.",
+			slog.String("node", name),
+			slog.String("action", req.Action),
+			slog.String("outcome", outcome),
+			slog.String("error", err.Error()),
+		)
+		result.Outcome = outcome
+		result.Error = err.Error()
+		return result
+	}
+
+	conn, ok := o.GetNode(name)
+	if !ok {
+		return fail(FleetUnreachable, fmt.Errorf("node %s not registered", name))
+	}
+	client := o.proxy.client(&conn)
+	base := fmt.Sprintf("https://%s:%d", conn.Address, conn.Port)
+
+	// Start the job
+	params := map[string]interface{}{}
+	for k, v := range req.Params {
+		params[k] = v
+	}
+	params["async"] = "true"
+	body, err := json.Marshal(params)
+	if err != nil {
+		return fail(FleetFailed, err)
+	}
+	startReq, err := http.NewRequestWithContext(ctx, "POST", fmt.Sprintf("%s/action/%s", base, req.Action), bytes.NewReader(body))
+	if err != nil {
+		return fail(FleetFailed, err)
+	}
+	startReq.Header = req.Headers.Clone()
+	startReq.Header.Set("Content-Type", "application/json")
+	resp, err := client.Do(startReq)
+	if err != nil {
+		return fail(FleetUnreachable, err)
+	}
+	startBody, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return fail(FleetUnreachable, err)
+	}
+	// Nodes answer 202 when the job has to wait for resources
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusAccepted {
+		return fail(FleetFailed, fmt.Errorf("node answered %d: %s", resp.StatusCode, strings.TrimSpace(string(startBody))))
+	}
+	var job nodeJob
+	if err := json.Unmarshal(startBody, &job); err != nil {
+		return fail(FleetFailed, fmt.Errorf("unable to parse job from node: %w", err))
+	}
+
+	// Follow its output until it is done
+	streamReq, err := http.NewRequestWithContext(ctx, "GET", fmt.Sprintf("%s/jobs/%s/stream", base, job.ID), nil)
+	if err != nil {
+		return fail(FleetFailed, err)
+	}
+	streamReq.Header = req.Headers.Clone()
+	streamReq.Header.Set("Accept", "text/event-stream")
+	resp, err = client.Do(streamReq)
+	if err != nil {
+		return fail(FleetUnreachable, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fail(FleetFailed, fmt.Errorf("unable to follow job %s: %d", job.ID, resp.StatusCode))
+	}
+
+	var finished json.RawMessage
+	err = hook.ReadEvents(resp.Body, func(event string, data []byte) error {
+		switch event {
+		case hook.EventUpdate:
+			var u hook.Update
+			if err := json.Unmarshal(data, &u); err != nil {
+				return err
+			}
+			emit(hook.EventUpdate, FleetUpdate{Node: name, Update: u})
+		case hook.EventDone:
+			finished = append(json.RawMessage{}, data...)
+		}
+		return nil
+	})
+	if err != nil {
+		return fail(FleetUnreachable, fmt.Errorf("lost job %s: %w", job.ID, err))
+	}
+	if finished == nil {
+		return fail(FleetUnreachable, fmt.Errorf("stream for job %s ended before the job finished", job.ID))
+	}
+	if err := json.Unmarshal(finished, &job); err != nil {
+		return fail(FleetFailed, fmt.Errorf("unable to parse job from node: %w", err))
+	}
+
+	result.Job = finished
+	result.ExitCodes = job.ExitCodes
+	// Nodes use the same word for jobs that succeeded
+	if job.Status != FleetSucceeded {
+		err := fmt.Errorf("job %s %s", job.ID, job.Status)
+		if job.Error != "" {
+			err = fmt.Errorf("%w: %s", err, job.Error)
+		}
+		return fail(FleetFailed, err)
+	}
+	result.Outcome = FleetSucceeded
+	return result
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
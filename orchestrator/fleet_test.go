@@ -0,0 +1,157 @@
+package orchestrator
+
+import (
+	"context"
+	"io"
+	"reflect"
+	"testing"
+
+	"golang.org/x/exp/slog"
+)
+
+var discardLogger = slog.New(slog.NewTextHandler(io.Discard))
+
+func TestFleetReport(t *testing.T) {
+	report := NewFleetReport("build")
+	for _, result := range []*FleetNodeResult{
+		{Node: "c", Outcome: FleetSucceeded},
+		{Node: "b", Outcome: FleetFailed},
+		{Node: "a", Outcome: FleetSucceeded},
+		{Node: "d", Outcome: FleetUnreachable},
+	} {
+		report.add(result)
+	}
+	if !reflect.DeepEqual(report.Succeeded, []string{"a", "c"}) {
+		t.Errorf("succeeded: %v", report.Succeeded)
+	}
+	if !reflect.DeepEqual(report.Failed, []string{"b"}) {
+		t.Errorf("failed: %v", report.Failed)
+	}
+	if !reflect.DeepEqual(report.Unreachable, []string{"d"}) {
+		t.Errorf("unreachable: %v", report.Unreachable)
+	}
+	if report.failures() != 2 {
+		t.Errorf("failures: %d", report.failures())
+	}
+	if len(report.Results) != 4 {
+		t.Errorf("results: %v", report.Results)
+	}
+}
+
+func TestFleetTargets(t *testing.T) {
+	o := &Orchestrator{Nodes: map[string]*NodeConnection{
+		"b1": {Name: "b1", Labels: map[string]string{"role": "builder"}},
+		"b2": {Name: "b2", Labels: map[string]string{"role": "builder", "draining": ""}},
+		"r1": {Name: "r1", Labels: map[string]string{"role": "runner"}},
+	}}
+	tests := []struct {
+		names    []string
+		selector string
+		want     []string
+	}{
+		{nil, "", []string{"b1", "b2", "r1"}},
+		{nil, "role=builder", []string{"b1", "b2"}},
+		{nil, "role=builder,!draining", []string{"b1"}},
+		{nil, "role=tester", []string{}},
+		{[]string{"r1", "b1"}, "", []string{"b1", "r1"}},
+		{[]string{"r1", "b1"}, "role=builder", []string{"b1"}},
+		// Unregistered nodes are kept so they can be reported
+		{[]string{"gone", "b2"}, "role=builder", []string{"b2", "gone"}},
+	}
+	for _, test := range tests {
+		selector, err := ParseSelector(test.selector)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := o.fleetTargets(test.names, selector); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%v %q: got %v, want %v", test.names, test.selector, got, test.want)
+		}
+	}
+}
+
+func TestRunFleetReportsUnregisteredNodes(t *testing.T) {
+	o := &Orchestrator{Nodes: map[string]*NodeConnection{}}
+	results := []string{}
+	emit := func(event string, payload any) {
+		if event == FleetResultEvent {
+			results = append(results, payload.(*FleetNodeResult).Node)
+		}
+	}
+	req := &FleetRequest{Action: "build", MaxFailures: UnlimitedFailures}
+	report := o.RunFleet(context.Background(), []string{"a", "b"}, req, emit, discardLogger)
+	if !reflect.DeepEqual(report.Unreachable, []string{"a", "b"}) || report.Aborted {
+		t.Errorf("got %+v", report)
+	}
+	if len(results) != 2 {
+		t.Errorf("emitted results for %v", results)
+	}
+}
+
+func TestFleetBatches(t *testing.T) {
+	targets := []string{"a", "b", "c", "d", "e"}
+	tests := []struct {
+		name string
+		req  FleetRequest
+		want [][]string
+	}{
+		{"all at once", FleetRequest{}, [][]string{{"a", "b", "c", "d", "e"}}},
+		{"canary then the rest", FleetRequest{Canary: 1}, [][]string{{"a"}, {"b", "c", "d", "e"}}},
+		{"batches", FleetRequest{BatchSize: 2}, [][]string{{"a", "b"}, {"c", "d"}, {"e"}}},
+		{"canary then batches", FleetRequest{Canary: 2, BatchSize: 2}, [][]string{{"a", "b"}, {"c", "d"}, {"e"}}},
+		{"canary covers everything", FleetRequest{Canary: 9}, [][]string{{"a", "b", "c", "d", "e"}}},
+		{"batch larger than the fleet", FleetRequest{BatchSize: 9}, [][]string{{"a", "b", "c", "d", "e"}}},
+	}
+	for _, test := range tests {
+		if got := test.req.batches(targets); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestRunFleetAborts(t *testing.T) {
+	// None of the nodes are registered, so every one of them fails
+	tests := []struct {
+		name    string
+		req     FleetRequest
+		batches [][]string
+		skipped []string
+	}{
+		{"failed canary", FleetRequest{Canary: 1, MaxFailures: UnlimitedFailures}, [][]string{{"a"}}, []string{"b", "c", "d"}},
+		{"too many failures", FleetRequest{BatchSize: 1, MaxFailures: 1}, [][]string{{"a"}, {"b"}}, []string{"c", "d"}},
+		{"unlimited failures", FleetRequest{BatchSize: 2, MaxFailures: UnlimitedFailures}, [][]string{{"a", "b"}, {"c", "d"}}, []string{}},
+		{"failures in the last batch", FleetRequest{BatchSize: 2, MaxFailures: 2}, [][]string{{"a", "b"}, {"c", "d"}}, []string{}},
+	}
+	for _, test := range tests {
+		o := &Orchestrator{Nodes: map[string]*NodeConnection{}}
+		batches := 0
+		emit := func(event string, payload any) {
+			if event == FleetBatchEvent {
+				batches++
+			}
+		}
+		report := o.RunFleet(context.Background(), []string{"a", "b", "c", "d"}, &test.req, emit, discardLogger)
+		if !reflect.DeepEqual(report.Batches, test.batches) {
+			t.Errorf("%s: ran %v, want %v", test.name, report.Batches, test.batches)
+		}
+		if batches != len(test.batches) {
+			t.Errorf("%s: announced %d batches", test.name, batches)
+		}
+		if !reflect.DeepEqual(report.Skipped, test.skipped) {
+			t.Errorf("%s: skipped %v, want %v", test.name, report.Skipped, test.skipped)
+		}
+		if report.Aborted != (len(test.skipped) > 0) || (report.Aborted && report.AbortReason == "") {
+			t.Errorf("%s: aborted %v: %q", test.name, report.Aborted, report.AbortReason)
+		}
+	}
+}
+
+func TestRunFleetInterrupted(t *testing.T) {
+	o := &Orchestrator{Nodes: map[string]*NodeConnection{}}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	req := &FleetRequest{BatchSize: 1, MaxFailures: UnlimitedFailures}
+	report := o.RunFleet(ctx, []string{"a", "b"}, req, nil, discardLogger)
+	if !report.Aborted || !reflect.DeepEqual(report.Skipped, []string{"a", "b"}) {
+		t.Errorf("got %+v", report)
+	}
+}
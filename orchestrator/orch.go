@@ -3,22 +3,31 @@ package orchestrator
 import (
 	"context"
 	"sync"
+	"time"
 
 	"github.com/bofrim/gorch/utils"
 	"golang.org/x/exp/slog"
 )
 
 type Orchestrator struct {
-	Port     int
-	Nodes    map[string]*NodeConnection
-	LogFile  string
-	CertPath string
+	Port         int
+	Nodes        map[string]*NodeConnection
+	LogFile      string
+	CertPath     string
+	ProxyTimeout time.Duration
+	StateDir     string
+	proxy        *NodeProxy
+	store        *NodeStore
+	// When the nodes of the last run were restored
+	restored time.Time
+	mu       sync.RWMutex
 }
 
 func (orchestrator *Orchestrator) Run() (err error) {
 	if orchestrator.Nodes == nil {
 		orchestrator.Nodes = make(map[string]*NodeConnection)
 	}
+	orchestrator.proxy = NewNodeProxy(orchestrator.ProxyTimeout)
 	var logger *slog.Logger
 	var closeFn func()
 	if logger, closeFn, err = utils.SetupLogging(orchestrator.LogFile, slog.LevelDebug); err != nil {
@@ -26,6 +35,18 @@ func (orchestrator *Orchestrator) Run() (err error) {
 	}
 	defer closeFn()
 
+	// Pick up where the last run left off
+	if orchestrator.StateDir != "" {
+		if orchestrator.store, err = NewNodeStore(orchestrator.StateDir); err != nil {
+			logger.Error("Failed to open the node store.", err, slog.String("dir", orchestrator.StateDir))
+			return err
+		}
+		if err := orchestrator.restoreNodes(logger); err != nil {
+			logger.Error("Failed to restore nodes.", err, slog.String("dir", orchestrator.StateDir))
+			return err
+		}
+	}
+
 	var wg sync.WaitGroup
 	ctx, cancel := context.WithCancel(context.Background())
 	done := func() {
@@ -1,20 +1,26 @@
 package orchestrator
 
 import (
+	"bufio"
 	"context"
 	"crypto/tls"
+	"encoding/json"
 	"fmt"
 	"log"
+	"strconv"
+	"strings"
 	"time"
 
+	"github.com/bofrim/gorch/hook"
 	"github.com/gofiber/fiber/v2"
 	"golang.org/x/exp/slog"
 )
 
 type NodeRegistration struct {
-	NodeName string `json:"name"`
-	NodeAddr string `json:"addr"`
-	NodePort int    `json:"port"`
+	NodeName   string            `json:"name"`
+	NodeAddr   string            `json:"addr"`
+	NodePort   int               `json:"port"`
+	NodeLabels map[string]string `json:"labels"`
 }
 
 func OServerThread(orchestrator *Orchestrator, ctx context.Context, logger *slog.Logger, done func()) {
@@ -41,37 +47,25 @@ func OServerThread(orchestrator *Orchestrator, ctx context.Context, logger *slog
 		if r.NodeAddr == "" {
 			r.NodeAddr = c.IP()
 		}
-		_, ok := orchestrator.Nodes[r.NodeName]
-		if ok {
+		conn, isNew := orchestrator.Register(*r)
+		if !isNew {
 			logger.Info("Node already registered.",
 				slog.String("node", r.NodeName),
-				slog.Int("num_nodes", len(orchestrator.Nodes)),
 			)
 			return nil
 		} else {
-			conn := NodeConnection{
-				Name:            r.NodeName,
-				Address:         r.NodeAddr,
-				Port:            r.NodePort,
-				LastInteraction: time.Now(),
-			}
-			orchestrator.Nodes[r.NodeName] = &conn
-			log.Printf("Orchestrator now has %d nodes registered.\n", len(orchestrator.Nodes))
 			logger.Info("Registered node.",
 				slog.String("node", conn.Name),
 				slog.String("node_address", conn.Address),
 				slog.Int("node_port", conn.Port),
-				slog.Int("num_nodes", len(orchestrator.Nodes)),
+				slog.Int("num_nodes", len(orchestrator.GetNodes())),
 			)
 			return nil
 		}
 	})
 	app.Post("/ping/:name", func(c *fiber.Ctx) error {
 		name := c.Params("name")
-		node, ok := orchestrator.Nodes[name]
-		if ok {
-			node.LastInteraction = time.Now()
-		} else {
+		if !orchestrator.Ping(name) {
 			log.Printf("Orchestrator got pinged by %s, but it was not registered.\n", name)
 			c.Response().SetStatusCode(404)
 			return c.SendString("Node not registered.")
@@ -80,45 +74,152 @@ func OServerThread(orchestrator *Orchestrator, ctx context.Context, logger *slog
 
 	})
 	app.Get("/nodes", func(c *fiber.Ctx) error {
-		nodes := make([]string, len(orchestrator.Nodes))
-		i := 0
-		for k := range orchestrator.Nodes {
-			nodes[i] = k
-			i++
+		selector, err := ParseSelector(c.Query("selector"))
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).SendString(err.Error())
+		}
+		return c.JSON(orchestrator.SelectNodes(selector))
+	})
+	app.Get("/nodes/history", func(c *fiber.Ctx) error {
+		events, err := orchestrator.store.History(c.Query("node"))
+		if err != nil {
+			logger.Error("Failed to read node history.", err)
+			return c.Status(fiber.StatusInternalServerError).SendString(err.Error())
 		}
-		return c.JSON(orchestrator.Nodes)
+		return c.JSON(events)
 	})
 
-	app.Get("/:node/*", func(c *fiber.Ctx) error {
-		node := c.Params("node")
-		nodeConn, ok := orchestrator.Nodes[node]
-		if !ok {
-			c.Response().SetStatusCode(404)
-			return c.SendString(fmt.Sprintf("Node %s not registered.", node))
+	// Run an action on many nodes at once
+	app.Post("/fleet/action/:name", func(c *fiber.Ctx) error {
+		// Copy everything out of the request; it may be used after the handler returns
+		action := strings.Clone(c.Params("name"))
+		names := splitList(strings.Clone(c.Query("nodes")))
+		selector, err := ParseSelector(strings.Clone(c.Query("selector")))
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).SendString(err.Error())
 		}
+		if len(names) == 0 && len(selector) == 0 {
+			return c.Status(fiber.StatusBadRequest).SendString("Specify the nodes to run on with nodes and/or selector.")
+		}
+		req := &FleetRequest{
+			Action:      action,
+			MaxFailures: UnlimitedFailures,
+		}
+		for key, dest := range map[string]*int{
+			"concurrency":  &req.Concurrency,
+			"canary":       &req.Canary,
+			"batch_size":   &req.BatchSize,
+			"max_failures": &req.MaxFailures,
+		} {
+			if value := c.Query(key); value != "" {
+				n, err := strconv.Atoi(value)
+				if err != nil || n < 0 {
+					return c.Status(fiber.StatusBadRequest).SendString(fmt.Sprintf("invalid %s: %s", key, value))
+				}
+				*dest = n
+			}
+		}
+		if pause := c.Query("pause"); pause != "" {
+			if req.BatchPause, err = time.ParseDuration(pause); err != nil {
+				return c.Status(fiber.StatusBadRequest).SendString(fmt.Sprintf("invalid pause: %s", err))
+			}
+		}
+		// Both only take effect between batches
+		if !req.rolling() && (req.MaxFailures != UnlimitedFailures || req.BatchPause > 0) {
+			return c.Status(fiber.StatusBadRequest).SendString("max_failures and pause need canary or batch_size")
+		}
+		params := map[string]interface{}{}
+		if len(c.Body()) > 0 {
+			if err := json.Unmarshal(c.Body(), &params); err != nil {
+				return c.Status(fiber.StatusBadRequest).SendString(err.Error())
+			}
+		}
+		setRequestId(c)
+		req.Params = params
+		req.Headers = forwardedHeaders(c)
+		targets := orchestrator.fleetTargets(names, selector)
+		logger.Info("Running fleet action.",
+			slog.String("action", action),
+			slog.Any("nodes", targets),
+			slog.String("request_id", req.Headers.Get(RequestIdHeader)),
+		)
 
-		logger.Info("Redirecting get request.", slog.String("node", nodeConn.Name), slog.String("params", c.Params("*")))
-		nodeUrl := fmt.Sprintf("https://%s:%d/%s", nodeConn.Address, nodeConn.Port, c.Params("*"))
-		return c.Redirect(nodeUrl, fiber.StatusTemporaryRedirect)
+		if c.Query("stream") != "true" {
+			return c.JSON(orchestrator.RunFleet(context.Background(), targets, req, nil, logger))
+		}
+
+		c.Set("Content-Type", "text/event-stream")
+		c.Set("Cache-Control", "no-cache")
+		c.Context().SetBodyStreamWriter(func(w *bufio.Writer) {
+			// Stop following the nodes if the user goes away; the jobs keep running on the nodes
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			seq := 0
+			emit := func(event string, payload any) {
+				seq++
+				if err := hook.WriteEvent(w, event, seq, payload); err != nil {
+					cancel()
+					return
+				}
+				if err := w.Flush(); err != nil {
+					cancel()
+				}
+			}
+			report := orchestrator.RunFleet(ctx, targets, req, emit, logger)
+			emit(hook.EventDone, report)
+		})
+		return nil
 	})
 
-	app.Post("/:node/*", func(c *fiber.Ctx) error {
+	// Run an action on whichever node has room for it
+	app.Post("/any/action/:name", func(c *fiber.Ctx) error {
+		action := c.Params("name")
+		selector, err := ParseSelector(c.Query("selector"))
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).SendString(err.Error())
+		}
+		setRequestId(c)
+		candidates := orchestrator.placeAction(context.Background(), action, selector, forwardedHeaders(c), logger)
+
+		// Another request may have taken the room first, so fall back to the next best node
+		for _, candidate := range candidates {
+			resp, err := orchestrator.proxy.send(c, &candidate.Node, fmt.Sprintf("action/%s", action), logger)
+			if err != nil {
+				continue
+			}
+			if resp.StatusCode == fiber.StatusServiceUnavailable {
+				resp.Body.Close()
+				continue
+			}
+			logger.Info("Placed action.",
+				slog.String("action", action),
+				slog.String("node", candidate.Node.Name),
+				slog.Int("candidates", len(candidates)),
+			)
+			c.Set(PlacedNodeHeader, candidate.Node.Name)
+			return orchestrator.proxy.relay(c, &candidate.Node, resp, logger)
+		}
+		if len(candidates) == 0 {
+			return c.Status(fiber.StatusServiceUnavailable).SendString(fmt.Sprintf("No node has action %s and room to run it.", action))
+		}
+		return c.Status(fiber.StatusServiceUnavailable).SendString(
+			fmt.Sprintf("The %d nodes with room for action %s couldn't start it.", len(candidates), action))
+	})
+
+	// Everything else is forwarded to the node named in the first path segment
+	proxyHandler := func(c *fiber.Ctx) error {
 		node := c.Params("node")
-		nodeConn, ok := orchestrator.Nodes[node]
+		nodeConn, ok := orchestrator.GetNode(node)
 		if !ok {
 			c.Response().SetStatusCode(404)
 			return c.SendString(fmt.Sprintf("Node %s not registered.", node))
 		}
-
-		logger.Info("Redirecting post request.",
-			slog.String("node", nodeConn.Name),
-			slog.String("params", c.Params("*")),
-			slog.String("address", nodeConn.Address),
-			slog.Int("port", nodeConn.Port),
-		)
-		nodeUrl := fmt.Sprintf("https://%s:%d/%s", nodeConn.Address, nodeConn.Port, c.Params("*"))
-		return c.Redirect(nodeUrl, fiber.StatusTemporaryRedirect)
-	})
+		return orchestrator.proxy.Forward(c, &nodeConn, c.Params("*"), logger)
+	}
+	app.Get("/:node/*", proxyHandler)
+	app.Post("/:node/*", proxyHandler)
+	app.Put("/:node/*", proxyHandler)
+	app.Delete("/:node/*", proxyHandler)
 
 	if orchestrator.CertPath != "" {
 		// Create tls certificate
@@ -145,3 +246,14 @@ func OServerThread(orchestrator *Orchestrator, ctx context.Context, logger *slog
 		log.Println(err)
 	}
 }
+
+// Split a comma separated list, dropping empty entries
+func splitList(s string) []string {
+	out := []string{}
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			out = append(out, item)
+		}
+	}
+	return out
+}
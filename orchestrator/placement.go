@@ -0,0 +1,144 @@
+package orchestrator
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"golang.org/x/exp/slog"
+)
+
+// Time allowed for a node to report its actions and usage when placing an action
+const PlacementPollTimeout = 5 * time.Second
+
+// Header naming the node the orchestrator picked to run an action
+const PlacedNodeHeader = "X-Gorch-Node"
+
+// The parts of a node's resource usage the orchestrator cares about
+type nodeUsage struct {
+	Groups map[string]struct {
+		Count int64 `json:"count"`
+		Held  int64 `json:"held"`
+	} `json:"groups"`
+	Active []json.RawMessage `json:"active"`
+}
+
+// The parts of a node's actions the orchestrator cares about
+type nodeAction struct {
+	Resources map[string]int64 `json:"resource"`
+}
+
+// A node that is able to run an action right now
+type placement struct {
+	Node NodeConnection
+	// Fraction of the tightest requested group that would still be free after the action starts
+	Headroom float64
+	Active   int
+}
+
+// Find the nodes that have the action and enough free resources for it, best first.
+// The user's headers are passed along so nodes that need a token will answer.
+func (o *Orchestrator) placeAction(ctx context.Context, action string, selector Selector, headers http.Header, logger *slog.Logger) []placement {
+	ctx, cancel := context.WithTimeout(ctx, PlacementPollTimeout)
+	defer cancel()
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	candidates := []placement{}
+	for _, conn := range o.SelectNodes(selector) {
+		if conn.Status != NodeConnected {
+			continue
+		}
+		conn := conn
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			p, ok, err := o.checkPlacement(ctx, conn, action, headers)
+			if err != nil {
+				logger.Warn("Unable to check node for placement.",
+					slog.String("node", conn.Name),
+					slog.String("action", action),
+					slog.String("error", err.Error()),
+				)
+				return
+			}
+			if ok {
+				mu.Lock()
+				candidates = append(candidates, p)
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	// Most headroom first, then the least busy
+	sort.Slice(candidates, func(i, j int) bool {
+		a, b := candidates[i], candidates[j]
+		if a.Headroom != b.Headroom {
+			return a.Headroom > b.Headroom
+		}
+		if a.Active != b.Active {
+			return a.Active < b.Active
+		}
+		return a.Node.Name < b.Node.Name
+	})
+	return candidates
+}
+
+// Ask a node whether it has the action and room to run it
+func (o *Orchestrator) checkPlacement(ctx context.Context, conn NodeConnection, action string, headers http.Header) (placement, bool, error) {
+	p := placement{Node: conn, Headroom: 1}
+
+	actions := map[string]nodeAction{}
+	if err := o.getNodeJSON(ctx, conn, "action/", headers, &actions); err != nil {
+		return p, false, err
+	}
+	a, ok := actions[action]
+	if !ok {
+		return p, false, nil
+	}
+
+	var usage nodeUsage
+	if err := o.getNodeJSON(ctx, conn, "usage", headers, &usage); err != nil {
+		return p, false, err
+	}
+	p.Active = len(usage.Active)
+	for name, need := range a.Resources {
+		group, ok := usage.Groups[name]
+		if !ok {
+			return p, false, nil
+		}
+		free := group.Count - group.Held
+		if free < need {
+			return p, false, nil
+		}
+		if group.Count > 0 {
+			if headroom := float64(free-need) / float64(group.Count); headroom < p.Headroom {
+				p.Headroom = headroom
+			}
+		}
+	}
+	return p, true, nil
+}
+
+func (o *Orchestrator) getNodeJSON(ctx context.Context, conn NodeConnection, path string, headers http.Header, out any) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", fmt.Sprintf("https://%s:%d/%s", conn.Address, conn.Port, path), nil)
+	if err != nil {
+		return err
+	}
+	req.Header = headers.Clone()
+	req.Header.Del("Content-Type")
+	resp, err := o.proxy.client(&conn).Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET /%s answered %d", path, resp.StatusCode)
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
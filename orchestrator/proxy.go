@@ -0,0 +1,232 @@
+package orchestrator
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"golang.org/x/exp/slog"
+)
+
+// Default time to wait for a node to start answering a proxied request
+const DefaultProxyTimeout = 10 * time.Minute
+
+const ProxyDialTimeout = 5 * time.Second
+const ProxyIdleConnsPerNode = 10
+
+// Header used to correlate a request across the orchestrator and the node
+const RequestIdHeader = "X-Request-ID"
+
+// Headers that only apply to a single connection and must not be forwarded
+var hopHeaders = map[string]struct{}{
+	"Connection":          {},
+	"Keep-Alive":          {},
+	"Proxy-Authenticate":  {},
+	"Proxy-Authorization": {},
+	"Te":                  {},
+	"Trailer":             {},
+	"Transfer-Encoding":   {},
+	"Upgrade":             {},
+	"Host":                {},
+	"Content-Length":      {},
+}
+
+// Forwards user requests to nodes, keeping a pool of connections per node
+type NodeProxy struct {
+	Timeout time.Duration
+	mu      sync.Mutex
+	clients map[string]*proxyClient
+}
+
+type proxyClient struct {
+	target string
+	client *http.Client
+}
+
+func NewNodeProxy(timeout time.Duration) *NodeProxy {
+	if timeout == 0 {
+		timeout = DefaultProxyTimeout
+	}
+	return &NodeProxy{
+		Timeout: timeout,
+		clients: map[string]*proxyClient{},
+	}
+}
+
+// Get the client for a node, replacing it if the node has moved
+func (p *NodeProxy) client(conn *NodeConnection) *http.Client {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	target := fmt.Sprintf("%s:%d", conn.Address, conn.Port)
+	if pc, ok := p.clients[conn.Name]; ok {
+		if pc.target == target {
+			return pc.client
+		}
+		pc.client.CloseIdleConnections()
+	}
+
+	pc := &proxyClient{
+		target: target,
+		client: &http.Client{
+			Transport: &http.Transport{
+				DialContext: (&net.Dialer{
+					Timeout: ProxyDialTimeout,
+				}).DialContext,
+				TLSClientConfig: &tls.Config{
+					InsecureSkipVerify: true,
+				},
+				TLSHandshakeTimeout:   ProxyDialTimeout,
+				ResponseHeaderTimeout: p.Timeout,
+				MaxIdleConnsPerHost:   ProxyIdleConnsPerNode,
+			},
+			// Pass redirects from the node back to the user untouched
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+	}
+	p.clients[conn.Name] = pc
+	return pc.client
+}
+
+// Close the pooled connections of a node that has gone away
+func (p *NodeProxy) Drop(name string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if pc, ok := p.clients[name]; ok {
+		pc.client.CloseIdleConnections()
+		delete(p.clients, name)
+	}
+}
+
+// Copy the headers of a user's request that should be passed on to a node
+func forwardedHeaders(c *fiber.Ctx) http.Header {
+	headers := http.Header{}
+	c.Request().Header.VisitAll(func(key, value []byte) {
+		if _, hop := hopHeaders[string(key)]; !hop {
+			headers.Add(string(key), string(value))
+		}
+	})
+	headers.Set(RequestIdHeader, c.GetRespHeader(RequestIdHeader))
+	headers.Set("X-Forwarded-For", c.IP())
+	return headers
+}
+
+// Tag the request with an id, reusing the one the user gave if there is one
+func setRequestId(c *fiber.Ctx) string {
+	requestId := c.Get(RequestIdHeader)
+	if requestId == "" {
+		requestId = uuid.NewString()
+	}
+	c.Set(RequestIdHeader, requestId)
+	return requestId
+}
+
+// Forward the request to path on the node and relay the node's response as it arrives
+func (p *NodeProxy) Forward(c *fiber.Ctx, conn *NodeConnection, path string, logger *slog.Logger) error {
+	resp, err := p.send(c, conn, path, logger)
+	if err != nil {
+		return p.sendError(c, conn, err)
+	}
+	return p.relay(c, conn, resp, logger)
+}
+
+// Send the user's request on to path on the node
+func (p *NodeProxy) send(c *fiber.Ctx, conn *NodeConnection, path string, logger *slog.Logger) (*http.Response, error) {
+	requestId := setRequestId(c)
+
+	url := fmt.Sprintf("https://%s:%d/%s", conn.Address, conn.Port, strings.TrimPrefix(path, "/"))
+	if query := c.Request().URI().QueryString(); len(query) > 0 {
+		url = fmt.Sprintf("%s?%s", url, query)
+	}
+
+	req, err := http.NewRequestWithContext(context.Background(), c.Method(), url, bytes.NewReader(c.Body()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header = forwardedHeaders(c)
+
+	logger.Info("Proxying request.",
+		slog.String("node", conn.Name),
+		slog.String("method", c.Method()),
+		slog.String("path", path),
+		slog.String("request_id", requestId),
+	)
+	resp, err := p.client(conn).Do(req)
+	if err != nil {
+		logger.Error("Proxied request failed.", err,
+			slog.String("node", conn.Name),
+			slog.String("request_id", requestId),
+		)
+		return nil, err
+	}
+	return resp, nil
+}
+
+// Tell the user the node couldn't be reached
+func (p *NodeProxy) sendError(c *fiber.Ctx, conn *NodeConnection, err error) error {
+	status := fiber.StatusBadGateway
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		status = fiber.StatusGatewayTimeout
+	}
+	return c.Status(status).SendString(fmt.Sprintf("Unable to reach node %s: %s", conn.Name, err))
+}
+
+// Pass the node's response back to the user
+func (p *NodeProxy) relay(c *fiber.Ctx, conn *NodeConnection, resp *http.Response, logger *slog.Logger) error {
+	requestId := strings.Clone(c.GetRespHeader(RequestIdHeader))
+	c.Status(resp.StatusCode)
+	for key, values := range resp.Header {
+		if _, hop := hopHeaders[key]; hop {
+			continue
+		}
+		for i, v := range values {
+			if i == 0 {
+				c.Response().Header.Set(key, v)
+			} else {
+				c.Response().Header.Add(key, v)
+			}
+		}
+	}
+
+	// Relay the body as it arrives so streamed responses aren't held up
+	c.Context().SetBodyStreamWriter(func(w *bufio.Writer) {
+		defer resp.Body.Close()
+		buf := make([]byte, 32*1024)
+		for {
+			n, err := resp.Body.Read(buf)
+			if n > 0 {
+				if _, wErr := w.Write(buf[:n]); wErr != nil {
+					return
+				}
+				if fErr := w.Flush(); fErr != nil {
+					return
+				}
+			}
+			if err != nil {
+				if err != io.EOF {
+					logger.Warn("Proxied response ended early.",
+						slog.String("node", conn.Name),
+						slog.String("request_id", requestId),
+						slog.String("error", err.Error()),
+					)
+				}
+				return
+			}
+		}
+	})
+	return nil
+}
@@ -0,0 +1,161 @@
+package orchestrator
+
+import (
+	"time"
+
+	"golang.org/x/exp/maps"
+	"golang.org/x/exp/slog"
+)
+
+// States a registered node can be in
+const (
+	NodeConnected = "connected"
+	// Restored from the store and not heard from since the orchestrator started
+	NodeUnknown = "unknown"
+)
+
+// Restore nodes saved by a previous run. They are reported as unknown until they check in.
+func (o *Orchestrator) restoreNodes(logger *slog.Logger) error {
+	nodes, err := o.store.Load()
+	if err != nil {
+		return err
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.restored = time.Now()
+	for name, n := range nodes {
+		if _, ok := o.Nodes[name]; ok {
+			continue
+		}
+		n.Status = NodeUnknown
+		o.Nodes[name] = n
+	}
+	logger.Info("Restored nodes.", slog.Int("num_nodes", len(nodes)))
+	return nil
+}
+
+// Add a node, or update it if it was already known. Returns true if the node is new.
+func (o *Orchestrator) Register(r NodeRegistration) (NodeConnection, bool) {
+	o.mu.Lock()
+	conn, ok := o.Nodes[r.NodeName]
+	event := NodeReconnectedEvent
+	if !ok {
+		conn = &NodeConnection{Name: r.NodeName}
+		o.Nodes[r.NodeName] = conn
+		event = NodeRegisteredEvent
+	}
+	// Only note a reconnection if something actually changed
+	changed := !ok || conn.Status != NodeConnected || conn.Address != r.NodeAddr || conn.Port != r.NodePort ||
+		!maps.Equal(conn.Labels, r.NodeLabels)
+	conn.Address = r.NodeAddr
+	conn.Port = r.NodePort
+	conn.Labels = r.NodeLabels
+	conn.Status = NodeConnected
+	conn.LastInteraction = time.Now()
+	out := *conn
+	o.mu.Unlock()
+
+	if changed {
+		o.recordEvent(out, event)
+		o.saveNodes()
+	}
+	return out, !ok
+}
+
+// Note that a node checked in. Returns false if the node isn't registered.
+func (o *Orchestrator) Ping(name string) bool {
+	o.mu.Lock()
+	conn, ok := o.Nodes[name]
+	if !ok {
+		o.mu.Unlock()
+		return false
+	}
+	reconnected := conn.Status != NodeConnected
+	conn.Status = NodeConnected
+	conn.LastInteraction = time.Now()
+	out := *conn
+	o.mu.Unlock()
+
+	if reconnected {
+		o.recordEvent(out, NodeReconnectedEvent)
+		o.saveNodes()
+	}
+	return true
+}
+
+func (o *Orchestrator) GetNode(name string) (NodeConnection, bool) {
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+	conn, ok := o.Nodes[name]
+	if !ok {
+		return NodeConnection{}, false
+	}
+	return *conn, true
+}
+
+func (o *Orchestrator) GetNodes() map[string]NodeConnection {
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+	nodes := make(map[string]NodeConnection, len(o.Nodes))
+	for name, conn := range o.Nodes {
+		nodes[name] = *conn
+	}
+	return nodes
+}
+
+// Get the nodes whose labels match the selector
+func (o *Orchestrator) SelectNodes(selector Selector) map[string]NodeConnection {
+	nodes := o.GetNodes()
+	for name, conn := range nodes {
+		if !selector.Matches(conn.Labels) {
+			delete(nodes, name)
+		}
+	}
+	return nodes
+}
+
+// Remove connected nodes that haven't been heard from in DisconnectStaleNodePeriod,
+// and restored nodes still unknown ForgetUnknownNodePeriod after they were restored.
+// Returns the removed nodes.
+func (o *Orchestrator) dropStale(now time.Time) []NodeConnection {
+	o.mu.Lock()
+	cutoff := now.Add(-DisconnectStaleNodePeriod)
+	forgetUnknown := now.Sub(o.restored) > ForgetUnknownNodePeriod
+	dropped := []NodeConnection{}
+	for name, n := range o.Nodes {
+		stale := n.Status == NodeConnected && n.LastInteraction.Before(cutoff)
+		if stale || (n.Status == NodeUnknown && forgetUnknown) {
+			delete(o.Nodes, name)
+			dropped = append(dropped, *n)
+		}
+	}
+	o.mu.Unlock()
+
+	for _, n := range dropped {
+		event := NodeDisconnectedEvent
+		if n.Status == NodeUnknown {
+			event = NodeForgottenEvent
+		}
+		o.recordEvent(n, event)
+	}
+	return dropped
+}
+
+func (o *Orchestrator) recordEvent(conn NodeConnection, event string) {
+	err := o.store.Record(NodeEvent{
+		Time:    time.Now(),
+		Node:    conn.Name,
+		Event:   event,
+		Address: conn.Address,
+		Port:    conn.Port,
+	})
+	if err != nil {
+		slog.Default().Error("Failed to record node event.", err, slog.String("node", conn.Name))
+	}
+}
+
+func (o *Orchestrator) saveNodes() {
+	if err := o.store.Save(o.GetNodes()); err != nil {
+		slog.Default().Error("Failed to save nodes.", err)
+	}
+}
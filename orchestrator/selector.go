@@ -0,0 +1,84 @@
+package orchestrator
+
+import (
+	"fmt"
+	"strings"
+)
+
+type selectorOp string
+
+const (
+	selectorEquals    selectorOp = "="
+	selectorNotEquals selectorOp = "!="
+	selectorExists    selectorOp = "exists"
+	selectorNotExists selectorOp = "!exists"
+)
+
+type requirement struct {
+	key   string
+	op    selectorOp
+	value string
+}
+
+// A set of label requirements that must all hold for a node to match, written like
+// "role=builder,region!=eu,gpu,!draining"
+type Selector []requirement
+
+func ParseSelector(s string) (Selector, error) {
+	selector := Selector{}
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+
+		var r requirement
+		switch {
+		case strings.Contains(part, "!="):
+			kv := strings.SplitN(part, "!=", 2)
+			r = requirement{key: kv[0], op: selectorNotEquals, value: kv[1]}
+		case strings.Contains(part, "=="):
+			kv := strings.SplitN(part, "==", 2)
+			r = requirement{key: kv[0], op: selectorEquals, value: kv[1]}
+		case strings.Contains(part, "="):
+			kv := strings.SplitN(part, "=", 2)
+			r = requirement{key: kv[0], op: selectorEquals, value: kv[1]}
+		case strings.HasPrefix(part, "!"):
+			r = requirement{key: strings.TrimPrefix(part, "!"), op: selectorNotExists}
+		default:
+			r = requirement{key: part, op: selectorExists}
+		}
+		r.key = strings.TrimSpace(r.key)
+		r.value = strings.TrimSpace(r.value)
+		if r.key == "" {
+			return nil, fmt.Errorf("invalid selector requirement '%s': missing label name", part)
+		}
+		selector = append(selector, r)
+	}
+	return selector, nil
+}
+
+func (s Selector) Matches(labels map[string]string) bool {
+	for _, r := range s {
+		value, ok := labels[r.key]
+		switch r.op {
+		case selectorEquals:
+			if !ok || value != r.value {
+				return false
+			}
+		case selectorNotEquals:
+			if ok && value == r.value {
+				return false
+			}
+		case selectorExists:
+			if !ok {
+				return false
+			}
+		case selectorNotExists:
+			if ok {
+				return false
+			}
+		}
+	}
+	return true
+}
@@ -0,0 +1,70 @@
+package orchestrator
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseSelector(t *testing.T) {
+	tests := []struct {
+		selector string
+		want     Selector
+		err      bool
+	}{
+		{"", Selector{}, false},
+		{"role=builder", Selector{{"role", selectorEquals, "builder"}}, false},
+		{"role==builder", Selector{{"role", selectorEquals, "builder"}}, false},
+		{"region!=eu", Selector{{"region", selectorNotEquals, "eu"}}, false},
+		{"gpu", Selector{{"gpu", selectorExists, ""}}, false},
+		{"!draining", Selector{{"draining", selectorNotExists, ""}}, false},
+		{" role = builder , gpu ,, ", Selector{{"role", selectorEquals, "builder"}, {"gpu", selectorExists, ""}}, false},
+		{"role=", Selector{{"role", selectorEquals, ""}}, false},
+		{"=builder", nil, true},
+		{"!", nil, true},
+		{"gpu,!=x", nil, true},
+	}
+	for _, test := range tests {
+		got, err := ParseSelector(test.selector)
+		if (err != nil) != test.err {
+			t.Errorf("%q: unexpected error %v", test.selector, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%q: got %v, want %v", test.selector, got, test.want)
+		}
+	}
+}
+
+func TestSelectorMatches(t *testing.T) {
+	labels := map[string]string{"role": "builder", "region": "us", "gpu": ""}
+	tests := []struct {
+		selector string
+		matches  bool
+	}{
+		{"", true},
+		{"role=builder", true},
+		{"role=runner", false},
+		{"zone=a", false},
+		{"region!=eu", true},
+		{"region!=us", false},
+		{"zone!=a", true},
+		{"gpu", true},
+		{"draining", false},
+		{"!draining", true},
+		{"!gpu", false},
+		{"role=builder,region=us,gpu,!draining", true},
+		{"role=builder,region=eu", false},
+	}
+	for _, test := range tests {
+		selector, err := ParseSelector(test.selector)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := selector.Matches(labels); got != test.matches {
+			t.Errorf("%q: got %v, want %v", test.selector, got, test.matches)
+		}
+	}
+	if !(Selector{{"gpu", selectorNotExists, ""}}).Matches(nil) {
+		t.Error("a node without labels doesn't have any")
+	}
+}
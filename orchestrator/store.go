@@ -0,0 +1,135 @@
+package orchestrator
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const nodeSnapshotFile = "nodes.json"
+const nodeEventLogFile = "events.log"
+
+// Kinds of events recorded in the node history
+const (
+	NodeRegisteredEvent   = "registered"
+	NodeReconnectedEvent  = "reconnected"
+	NodeDisconnectedEvent = "disconnected"
+	// A restored node that never checked in again
+	NodeForgottenEvent = "forgotten"
+)
+
+type NodeEvent struct {
+	Time    time.Time `json:"time"`
+	Node    string    `json:"node"`
+	Event   string    `json:"event"`
+	Address string    `json:"address,omitempty"`
+	Port    int       `json:"port,omitempty"`
+}
+
+// Keeps the orchestrator's nodes on disk as a JSON snapshot along with an
+// append only log of when nodes came and went. A nil store does nothing.
+type NodeStore struct {
+	Dir string
+	mu  sync.Mutex
+}
+
+func NewNodeStore(dir string) (*NodeStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &NodeStore{Dir: dir}, nil
+}
+
+// Read the last snapshot of nodes. Returns an empty map if there isn't one yet.
+func (s *NodeStore) Load() (map[string]*NodeConnection, error) {
+	nodes := map[string]*NodeConnection{}
+	if s == nil {
+		return nodes, nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	data, err := os.ReadFile(filepath.Join(s.Dir, nodeSnapshotFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return nodes, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &nodes); err != nil {
+		return nil, err
+	}
+	return nodes, nil
+}
+
+// Replace the snapshot with the given nodes
+func (s *NodeStore) Save(nodes map[string]NodeConnection) error {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	data, err := json.MarshalIndent(nodes, "", "  ")
+	if err != nil {
+		return err
+	}
+	// Write then rename so a crash never leaves a partial snapshot behind
+	tmp := filepath.Join(s.Dir, nodeSnapshotFile+".tmp")
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(s.Dir, nodeSnapshotFile))
+}
+
+// Append an event to the node history
+func (s *NodeStore) Record(event NodeEvent) error {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	file, err := os.OpenFile(filepath.Join(s.Dir, nodeEventLogFile), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return json.NewEncoder(file).Encode(event)
+}
+
+// Read the node history, optionally only for a single node
+func (s *NodeStore) History(node string) ([]NodeEvent, error) {
+	events := []NodeEvent{}
+	if s == nil {
+		return events, nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	file, err := os.Open(filepath.Join(s.Dir, nodeEventLogFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return events, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var event NodeEvent
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			// Skip lines that were only partially written
+			continue
+		}
+		if node == "" || event.Node == node {
+			events = append(events, event)
+		}
+	}
+	return events, scanner.Err()
+}
@@ -0,0 +1,128 @@
+package orchestrator
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestNodeStoreSnapshot(t *testing.T) {
+	store, err := NewNodeStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if nodes, err := store.Load(); err != nil || len(nodes) != 0 {
+		t.Fatalf("loading before anything was saved: %v, %v", nodes, err)
+	}
+
+	seen := time.Date(2023, 1, 2, 3, 4, 5, 0, time.UTC)
+	saved := map[string]NodeConnection{
+		"a": {Name: "a", Address: "10.0.0.1", Port: 8000, Labels: map[string]string{"role": "db"}, Status: NodeConnected, LastInteraction: seen},
+		"b": {Name: "b", Address: "10.0.0.2", Port: 8001, Status: NodeConnected, LastInteraction: seen},
+	}
+	if err := store.Save(saved); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := store.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range saved {
+		if got, ok := loaded[name]; !ok || !reflect.DeepEqual(*got, want) {
+			t.Errorf("node %s: got %+v, want %+v", name, got, want)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(store.Dir, nodeSnapshotFile+".tmp")); err == nil {
+		t.Error("the temporary snapshot was left behind")
+	}
+}
+
+func TestNodeStoreHistory(t *testing.T) {
+	store, err := NewNodeStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	events := []NodeEvent{
+		{Node: "a", Event: NodeRegisteredEvent},
+		{Node: "b", Event: NodeRegisteredEvent},
+		{Node: "a", Event: NodeDisconnectedEvent},
+		{Node: "a", Event: NodeReconnectedEvent},
+	}
+	for _, event := range events {
+		if err := store.Record(event); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// A line cut short by a crash
+	f, _ := os.OpenFile(filepath.Join(store.Dir, nodeEventLogFile), os.O_APPEND|os.O_WRONLY, 0644)
+	f.WriteString(`{"node":"a","ev`)
+	f.Close()
+
+	tests := []struct {
+		node string
+		want []string
+	}{
+		{"", []string{"a registered", "b registered", "a disconnected", "a reconnected"}},
+		{"a", []string{"a registered", "a disconnected", "a reconnected"}},
+		{"b", []string{"b registered"}},
+		{"c", []string{}},
+	}
+	for _, test := range tests {
+		history, err := store.History(test.node)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := []string{}
+		for _, event := range history {
+			got = append(got, event.Node+" "+event.Event)
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("history of %q: got %q, want %q", test.node, got, test.want)
+		}
+	}
+}
+
+func TestNilNodeStore(t *testing.T) {
+	var store *NodeStore
+	if err := store.Save(map[string]NodeConnection{"a": {}}); err != nil {
+		t.Error(err)
+	}
+	if err := store.Record(NodeEvent{Node: "a"}); err != nil {
+		t.Error(err)
+	}
+	if nodes, err := store.Load(); err != nil || len(nodes) != 0 {
+		t.Errorf("got %v, %v", nodes, err)
+	}
+	if history, err := store.History(""); err != nil || len(history) != 0 {
+		t.Errorf("got %v, %v", history, err)
+	}
+}
+
+func TestDropStale(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name     string
+		restored time.Time
+		node     NodeConnection
+		dropped  bool
+	}{
+		{"connected and fresh", now, NodeConnection{Status: NodeConnected, LastInteraction: now}, false},
+		{"connected and stale", now, NodeConnection{Status: NodeConnected, LastInteraction: now.Add(-time.Minute)}, true},
+		{"restored recently", now.Add(-time.Hour), NodeConnection{Status: NodeUnknown, LastInteraction: now.Add(-48 * time.Hour)}, false},
+		{"restored long ago", now.Add(-ForgetUnknownNodePeriod - time.Minute), NodeConnection{Status: NodeUnknown}, true},
+	}
+	for _, test := range tests {
+		node := test.node
+		node.Name = "n"
+		o := &Orchestrator{Nodes: map[string]*NodeConnection{"n": &node}, restored: test.restored}
+		dropped := o.dropStale(now)
+		if (len(dropped) == 1) != test.dropped {
+			t.Errorf("%s: dropped %v", test.name, dropped)
+		}
+		if _, ok := o.Nodes["n"]; ok == test.dropped {
+			t.Errorf("%s: still registered: %v", test.name, ok)
+		}
+	}
+}
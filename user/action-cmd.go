@@ -5,8 +5,11 @@ import (
 	"fmt"
 	"os"
 	"regexp"
+	"sort"
 	"strings"
 
+	gnode "github.com/bofrim/gorch/node"
+	"github.com/bofrim/gorch/orchestrator"
 	"github.com/urfave/cli/v2"
 	"golang.org/x/exp/maps"
 )
@@ -24,9 +27,46 @@ var actionCommand = cli.Command{
 			Value: "127.0.0.1:443",
 		},
 		&cli.StringFlag{
-			Name:     "node",
-			Usage:    "Specify the node to perform the action on.",
-			Required: true,
+			Name:  "node",
+			Usage: "Specify the node to perform the action on.",
+		},
+		&cli.StringSliceFlag{
+			Name:  "nodes",
+			Usage: "Perform the action on each of these nodes. Comma separated or repeated.",
+		},
+		&cli.StringFlag{
+			Name:  "selector",
+			Usage: "Perform the action on every node whose labels match, e.g. 'region=us-east,role!=db'",
+		},
+		&cli.BoolFlag{
+			Name:  "any",
+			Usage: "Perform the action on one node that has room for it, picked by the orchestrator. Narrow the choice with --selector.",
+			Value: false,
+		},
+		&cli.IntFlag{
+			Name:  "concurrency",
+			Usage: "The most nodes to run the action on at once when using --nodes or --selector.",
+			Value: 0,
+		},
+		&cli.IntFlag{
+			Name:  "canary",
+			Usage: "Run the action on this many nodes first, and stop if any of them fail.",
+			Value: 0,
+		},
+		&cli.IntFlag{
+			Name:  "batch-size",
+			Usage: "Run the action on this many nodes at a time, waiting for each batch to finish before the next.",
+			Value: 0,
+		},
+		&cli.IntFlag{
+			Name:  "max-failures",
+			Usage: "Stop before the next batch once more than this many nodes have failed. Negative for no limit.",
+			Value: -1,
+		},
+		&cli.DurationFlag{
+			Name:  "pause",
+			Usage: "Time to wait between batches.",
+			Value: 0,
 		},
 		&cli.StringFlag{
 			Name:     "action",
@@ -69,6 +109,11 @@ var actionCommand = cli.Command{
 				return nil
 			},
 		},
+		&cli.BoolFlag{
+			Name:  "stream",
+			Usage: "Stream the output of the action from the node, without opening a port for it.",
+			Value: false,
+		},
 		&cli.StringSliceFlag{
 			Name:  "header",
 			Usage: "Specify a header to pass along. Formatted like 'key: value'",
@@ -92,6 +137,42 @@ var actionCommand = cli.Command{
 		addr := ctx.String("orchestrator")
 		node := ctx.String("node")
 		streamPort := ctx.Int("stream-port")
+		nodes := []string{}
+		for _, n := range ctx.StringSlice("nodes") {
+			for _, name := range strings.Split(n, ",") {
+				if name = strings.TrimSpace(name); name != "" {
+					nodes = append(nodes, name)
+				}
+			}
+		}
+		selector := ctx.String("selector")
+		anyNode := ctx.Bool("any")
+		fleet := !anyNode && (len(nodes) > 0 || selector != "")
+		if anyNode && (node != "" || len(nodes) > 0 || streamPort != 0) {
+			return fmt.Errorf("--any can't be combined with --node, --nodes, or --stream-port")
+		}
+		if node == "" && !fleet && !anyNode {
+			return fmt.Errorf("specify a node with --node, many with --nodes and/or --selector, or let the orchestrator pick with --any")
+		}
+		if node != "" && fleet {
+			return fmt.Errorf("--node can't be combined with --nodes or --selector")
+		}
+		if fleet && streamPort != 0 {
+			return fmt.Errorf("--stream-port can't be used with many nodes; use --stream instead")
+		}
+		for _, flag := range []string{"concurrency", "canary", "batch-size", "max-failures", "pause"} {
+			if !fleet && ctx.IsSet(flag) {
+				return fmt.Errorf("--%s only applies to --nodes or --selector", flag)
+			}
+		}
+		// Failures are only counted, and pauses only taken, between batches
+		rolling := ctx.Int("canary") > 0 || ctx.Int("batch-size") > 0
+		if !rolling && ctx.IsSet("max-failures") && ctx.Int("max-failures") >= 0 {
+			return fmt.Errorf("--max-failures needs --canary or --batch-size")
+		}
+		if !rolling && ctx.Duration("pause") > 0 {
+			return fmt.Errorf("--pause needs --canary or --batch-size")
+		}
 		action := ctx.String("action")
 
 		// Parse data
@@ -127,10 +208,72 @@ var actionCommand = cli.Command{
 		}
 
 		var runErr error
-		if streamPort != 0 {
+		if anyNode {
+			var job *gnode.Job
+			if ctx.Bool("stream") {
+				data["async"] = "true"
+			}
+			if node, job, runErr = PlaceAction(addr, selector, action, data, headers); runErr == nil {
+				fmt.Printf("Running on node %s\n", node)
+				if ctx.Bool("stream") {
+					fmt.Printf("Streaming job %s (%s)\n\n", job.ID, job.Action)
+					if job, runErr = StreamJob(addr, node, job.ID, headers); runErr == nil {
+						fmt.Printf("\nJob %s (%s): %s\n", job.ID, job.Action, job.Status)
+					}
+				} else {
+					if job.Status == gnode.JobQueued {
+						printQueued(job)
+						job, runErr = WaitJob(addr, node, job.ID, headers)
+					}
+					if runErr == nil {
+						printJob(job)
+					}
+				}
+				if runErr == nil && job.Status != gnode.JobSucceeded {
+					runErr = fmt.Errorf("job %s %s", job.ID, job.Status)
+				}
+			}
+		} else if fleet {
+			opts := FleetOptions{
+				Nodes:       nodes,
+				Selector:    selector,
+				Concurrency: ctx.Int("concurrency"),
+				Canary:      ctx.Int("canary"),
+				BatchSize:   ctx.Int("batch-size"),
+				MaxFailures: ctx.Int("max-failures"),
+				Pause:       ctx.Duration("pause"),
+				Stream:      ctx.Bool("stream"),
+			}
+			var report *orchestrator.FleetReport
+			if report, runErr = FleetAction(addr, opts, action, data, headers); runErr == nil {
+				if !opts.Stream {
+					printFleetReport(report)
+				}
+				printFleetSummary(report)
+				if report.Aborted {
+					runErr = fmt.Errorf("stopped early: %s", report.AbortReason)
+				} else if n := len(report.Failed) + len(report.Unreachable); n > 0 {
+					runErr = fmt.Errorf("action did not succeed on %d of %d nodes", n, len(report.Results))
+				}
+			}
+		} else if streamPort != 0 {
 			runErr = StreamAction(addr, node, streamPort, action, data, headers)
+		} else if ctx.Bool("stream") {
+			var job *gnode.Job
+			if job, runErr = PullAction(addr, node, action, data, headers); runErr == nil {
+				fmt.Printf("\nJob %s (%s): %s\n", job.ID, job.Action, job.Status)
+				if job.Status != gnode.JobSucceeded {
+					runErr = fmt.Errorf("job %s %s", job.ID, job.Status)
+				}
+			}
 		} else {
-			runErr = RunAction(addr, node, action, data, headers)
+			var job *gnode.Job
+			if job, runErr = RunAction(addr, node, action, data, headers); runErr == nil {
+				printJob(job)
+				if job.Status != gnode.JobSucceeded {
+					runErr = fmt.Errorf("job %s %s", job.ID, job.Status)
+				}
+			}
 		}
 		if runErr != nil {
 			fmt.Printf("Action Error: %v", runErr)
@@ -139,3 +282,74 @@ var actionCommand = cli.Command{
 		return nil
 	},
 }
+
+// Print a finished job with the output of each of its commands
+func printJob(job *gnode.Job) {
+	fmt.Printf("Job %s (%s): %s\n", job.ID, job.Action, job.Status)
+	for _, r := range job.Results {
+		fmt.Printf("\n$ %s\n", strings.Join(r.Command, " "))
+		if r.Truncated {
+			fmt.Printf("--- output truncated to the last %d bytes ---\n", gnode.CommandOutputLimit)
+		}
+		if r.Stdout != "" {
+			fmt.Print(r.Stdout)
+		}
+		if r.Stderr != "" {
+			fmt.Printf("--- stderr ---\n%s", r.Stderr)
+		}
+		fmt.Printf("--- exit code %d after %s ---\n", r.ExitCode, r.Duration)
+		if r.Error != "" {
+			fmt.Printf("error: %s\n", r.Error)
+		}
+	}
+	if job.Error != "" && len(job.Results) == 0 {
+		fmt.Printf("error: %s\n", job.Error)
+	}
+	fmt.Println()
+}
+
+// Print the full output of every node in a fleet report
+func printFleetReport(report *orchestrator.FleetReport) {
+	names := maps.Keys(report.Results)
+	sort.Strings(names)
+	for _, name := range names {
+		result := report.Results[name]
+		fmt.Printf("===== %s =====\n", name)
+		if result.Job == nil {
+			printFleetResult(result)
+			fmt.Println()
+			continue
+		}
+		job, err := parseJob(result.Job)
+		if err != nil {
+			fmt.Println(err)
+			continue
+		}
+		printJob(job)
+	}
+}
+
+// Print the outcome of the action on one node
+func printFleetResult(result *orchestrator.FleetNodeResult) {
+	line := fmt.Sprintf("[%s] %s", result.Node, result.Outcome)
+	if len(result.ExitCodes) > 0 {
+		line = fmt.Sprintf("%s, exit codes %v", line, result.ExitCodes)
+	}
+	if result.Error != "" {
+		line = fmt.Sprintf("%s: %s", line, result.Error)
+	}
+	fmt.Println(line)
+}
+
+func printFleetSummary(report *orchestrator.FleetReport) {
+	fmt.Printf("\n%s on %d nodes\n", report.Action, len(report.Results)+len(report.Skipped))
+	fmt.Printf("  succeeded (%d):   %s\n", len(report.Succeeded), strings.Join(report.Succeeded, ", "))
+	fmt.Printf("  failed (%d):      %s\n", len(report.Failed), strings.Join(report.Failed, ", "))
+	fmt.Printf("  unreachable (%d): %s\n", len(report.Unreachable), strings.Join(report.Unreachable, ", "))
+	if len(report.Skipped) > 0 {
+		fmt.Printf("  skipped (%d):     %s\n", len(report.Skipped), strings.Join(report.Skipped, ", "))
+	}
+	if report.Aborted {
+		fmt.Printf("Stopped early: %s\n", report.AbortReason)
+	}
+}
@@ -0,0 +1,78 @@
+package user
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/urfave/cli/v2"
+	"gopkg.in/yaml.v3"
+)
+
+var cancelCommand = cli.Command{
+	Name:  "cancel",
+	Usage: "Cancel a job running on a node.",
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:  "orchestrator",
+			Usage: "Specify the address of the gorch orchestrator",
+			Value: "127.0.0.1:443",
+		},
+		&cli.StringFlag{
+			Name:     "node",
+			Usage:    "Specify the node the job is running on.",
+			Required: true,
+		},
+		&cli.StringFlag{
+			Name:     "job",
+			Usage:    "Specify the id of the job to cancel.",
+			Required: true,
+		},
+		&cli.StringSliceFlag{
+			Name:  "header",
+			Usage: "Specify a header to pass along. Formatted like 'key: value'",
+			Action: func(ctx *cli.Context, v []string) error {
+				for _, h := range v {
+					splitHeader := strings.Split(h, ":")
+					if len(splitHeader) != 2 {
+						return fmt.Errorf("expected header to be formatted like 'key: value'. Got: %s", h)
+					}
+					key := strings.TrimSpace(splitHeader[0])
+					value := strings.TrimSpace(splitHeader[1])
+					if key == "" || value == "" {
+						return fmt.Errorf("header keys and values should not be empty. key: '%s'; value: '%s'", key, value)
+					}
+				}
+				return nil
+			},
+		},
+	},
+	Action: func(ctx *cli.Context) error {
+		headers := make(map[string]string)
+		for _, h := range ctx.StringSlice("header") {
+			splitHeader := strings.Split(h, ":")
+			key := strings.TrimSpace(splitHeader[0])
+			value := strings.TrimSpace(splitHeader[1])
+			headers[key] = value
+		}
+
+		raw, err := CancelJob(ctx.String("orchestrator"), ctx.String("node"), ctx.String("job"), headers)
+		if err != nil {
+			fmt.Printf("Cancel Error: %v\n", err)
+			return err
+		}
+
+		var o map[string]interface{}
+		if err := json.Unmarshal(raw, &o); err != nil {
+			fmt.Printf("Unmarshal Error: %s", err)
+			return err
+		}
+		y, err := yaml.Marshal(&o)
+		if err != nil {
+			fmt.Printf("Marshal Error: %s", err.Error())
+			return err
+		}
+		fmt.Printf("Cancelling job:\n%s", y)
+		return nil
+	},
+}
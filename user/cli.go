@@ -11,6 +11,7 @@ func GetCliCommand() *cli.Command {
 		Subcommands: []*cli.Command{
 			&infoCommand,
 			&actionCommand,
+			&cancelCommand,
 			&dataRequestCommand,
 			&dataListCommand,
 		},
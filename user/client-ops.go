@@ -7,15 +7,23 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
+	"strings"
+	"time"
 
 	"github.com/bofrim/gorch/hook"
+	gnode "github.com/bofrim/gorch/node"
+	"github.com/bofrim/gorch/orchestrator"
 )
 
 // Function for sending a get request to an orchestrator
-func GetNodes(addr string) ([]byte, error) {
+func GetNodes(addr string, selector string) ([]byte, error) {
 	// Prepare the request
-	url := fmt.Sprintf("https://%s/nodes", addr)
-	req, err := http.NewRequest("GET", url, nil)
+	nodesUrl := fmt.Sprintf("https://%s/nodes", addr)
+	if selector != "" {
+		nodesUrl = fmt.Sprintf("%s?selector=%s", nodesUrl, url.QueryEscape(selector))
+	}
+	req, err := http.NewRequest("GET", nodesUrl, nil)
 	if err != nil {
 		return nil, err
 	}
@@ -45,23 +53,293 @@ func GetNodes(addr string) ([]byte, error) {
 	return body, nil
 }
 
-func RunAction(addr string, node string, action string, data map[string]interface{}, headers map[string]string) error {
+// Run an action on a node and wait for it to finish. If the job has to wait
+// for resources on the node, this waits for it to start and finish too.
+func RunAction(addr string, node string, action string, data map[string]interface{}, headers map[string]string) (*gnode.Job, error) {
 	url := fmt.Sprintf("https://%s/%s/action/%s", addr, node, action)
-	return DoPostRequest(url, data, headers)
+	body, err := DoPostRequest(url, data, headers)
+	if err != nil {
+		return nil, err
+	}
+	job, err := parseJob(body)
+	if err != nil {
+		return nil, err
+	}
+	if job.Status == gnode.JobQueued {
+		printQueued(job)
+		return WaitJob(addr, node, job.ID, headers)
+	}
+	return job, nil
+}
+
+func printQueued(job *gnode.Job) {
+	fmt.Printf("Job %s (%s) is queued at position %d, waiting for resources\n", job.ID, job.Action, job.QueuePosition)
+}
+
+// Run an action on whichever node the orchestrator finds room on. Returns the node that was picked.
+func PlaceAction(addr string, selector string, action string, data map[string]interface{}, headers map[string]string) (string, *gnode.Job, error) {
+	placeUrl := fmt.Sprintf("https://%s/any/action/%s", addr, action)
+	if selector != "" {
+		placeUrl = fmt.Sprintf("%s?selector=%s", placeUrl, url.QueryEscape(selector))
+	}
+	body, respHeaders, err := doPostRequest(placeUrl, data, headers)
+	if err != nil {
+		return "", nil, err
+	}
+	job, err := parseJob(body)
+	if err != nil {
+		return "", nil, err
+	}
+	return respHeaders.Get(orchestrator.PlacedNodeHeader), job, nil
 }
 
 func StreamAction(addr string, node string, streamPort int, action string, data map[string]interface{}, headers map[string]string) error {
 	url := fmt.Sprintf("https://%s/%s/action/%s", addr, node, action)
 	data["stream_addr"] = "loopback"
 	data["stream_port"] = fmt.Sprintf("%d", streamPort)
-	postErr := DoPostRequest(url, data, headers)
+
+	// Start a hook listener before the action so no output is missed.
+	// If the port is taken by another listener, that one will show the output instead.
+	h := hook.NewHookListener()
+	bindErr := h.Bind(streamPort)
+	listenDone := make(chan error, 1)
+	if bindErr == nil {
+		go func() {
+			listenDone <- h.Serve()
+		}()
+	}
+
+	body, postErr := DoPostRequest(url, data, headers)
 	if postErr != nil {
 		return postErr
 	}
+	job, err := parseJob(body)
+	if err != nil {
+		return err
+	}
+	if bindErr != nil {
+		fmt.Printf("Port %d is in use (%s); job %s (%s) will stream to the listener already on it\n", streamPort, bindErr, job.ID, job.Action)
+		return nil
+	}
+	if job.Status == gnode.JobQueued {
+		printQueued(job)
+	}
+	fmt.Printf("Streaming job %s (%s) on port %d\n\n", job.ID, job.Action, streamPort)
+	return <-listenDone
+}
 
-	// Start a hook listener
-	h := hook.NewHookListener()
-	return h.Listen(streamPort)
+// Start an action in the background on the node, then follow its output from the node
+func PullAction(addr string, node string, action string, data map[string]interface{}, headers map[string]string) (*gnode.Job, error) {
+	url := fmt.Sprintf("https://%s/%s/action/%s", addr, node, action)
+	data["async"] = "true"
+	body, err := DoPostRequest(url, data, headers)
+	if err != nil {
+		return nil, err
+	}
+	job, err := parseJob(body)
+	if err != nil {
+		return nil, err
+	}
+	if job.Status == gnode.JobQueued {
+		printQueued(job)
+	}
+	fmt.Printf("Streaming job %s (%s)\n\n", job.ID, job.Action)
+	return StreamJob(addr, node, job.ID, headers)
+}
+
+// Print the output of a job as the node produces it. Returns the job once it is done.
+func StreamJob(addr string, node string, jobId string, headers map[string]string) (*gnode.Job, error) {
+	return followJob(addr, node, jobId, headers, func(u hook.Update) {
+		hook.PrintUpdate("", u)
+	})
+}
+
+// Wait for a job to finish without showing its output
+func WaitJob(addr string, node string, jobId string, headers map[string]string) (*gnode.Job, error) {
+	return followJob(addr, node, jobId, headers, func(u hook.Update) {})
+}
+
+func followJob(addr string, node string, jobId string, headers map[string]string, onUpdate func(hook.Update)) (*gnode.Job, error) {
+	url := fmt.Sprintf("https://%s/%s/jobs/%s/stream", addr, node, jobId)
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "text/event-stream")
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+
+	client := &http.Client{
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{
+				InsecureSkipVerify: true,
+			},
+		},
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("stream request not OK: %d; %s", resp.StatusCode, body)
+	}
+
+	var job *gnode.Job
+	err = hook.ReadEvents(resp.Body, func(event string, data []byte) error {
+		switch event {
+		case hook.EventUpdate:
+			var u hook.Update
+			if err := json.Unmarshal(data, &u); err != nil {
+				return err
+			}
+			onUpdate(u)
+		case hook.EventDone:
+			j, err := parseJob(data)
+			if err != nil {
+				return err
+			}
+			job = j
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if job == nil {
+		return nil, fmt.Errorf("stream for job %s ended before the job finished", jobId)
+	}
+	return job, nil
+}
+
+// How to run an action on many nodes
+type FleetOptions struct {
+	Nodes       []string
+	Selector    string
+	Concurrency int
+	Canary      int
+	BatchSize   int
+	// Negative for no limit
+	MaxFailures int
+	Pause       time.Duration
+	Stream      bool
+}
+
+func (o FleetOptions) query() url.Values {
+	query := url.Values{}
+	if len(o.Nodes) > 0 {
+		query.Set("nodes", strings.Join(o.Nodes, ","))
+	}
+	if o.Selector != "" {
+		query.Set("selector", o.Selector)
+	}
+	if o.Concurrency > 0 {
+		query.Set("concurrency", fmt.Sprintf("%d", o.Concurrency))
+	}
+	if o.Canary > 0 {
+		query.Set("canary", fmt.Sprintf("%d", o.Canary))
+	}
+	if o.BatchSize > 0 {
+		query.Set("batch_size", fmt.Sprintf("%d", o.BatchSize))
+	}
+	if o.MaxFailures >= 0 {
+		query.Set("max_failures", fmt.Sprintf("%d", o.MaxFailures))
+	}
+	if o.Pause > 0 {
+		query.Set("pause", o.Pause.String())
+	}
+	if o.Stream {
+		query.Set("stream", "true")
+	}
+	return query
+}
+
+// Run an action on many nodes through the orchestrator. When streaming, output
+// from every node is printed as it arrives, prefixed with the node's name.
+func FleetAction(addr string, opts FleetOptions, action string, data map[string]interface{}, headers map[string]string) (*orchestrator.FleetReport, error) {
+	query := opts.query()
+	if !opts.Stream {
+		body, err := DoPostRequest(fmt.Sprintf("https://%s/fleet/action/%s?%s", addr, action, query.Encode()), data, headers)
+		if err != nil {
+			return nil, err
+		}
+		return parseFleetReport(body)
+	}
+	serial, err := json.Marshal(data)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest("POST", fmt.Sprintf("https://%s/fleet/action/%s?%s", addr, action, query.Encode()), bytes.NewBuffer(serial))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "text/event-stream")
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+
+	client := &http.Client{
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{
+				InsecureSkipVerify: true,
+			},
+		},
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("fleet request not OK: %d; %s", resp.StatusCode, body)
+	}
+
+	var report *orchestrator.FleetReport
+	err = hook.ReadEvents(resp.Body, func(event string, data []byte) error {
+		switch event {
+		case hook.EventUpdate:
+			var fu orchestrator.FleetUpdate
+			if err := json.Unmarshal(data, &fu); err != nil {
+				return err
+			}
+			hook.PrintUpdate(fmt.Sprintf("[%s] ", fu.Node), fu.Update)
+		case orchestrator.FleetBatchEvent:
+			var batch orchestrator.FleetBatch
+			if err := json.Unmarshal(data, &batch); err != nil {
+				return err
+			}
+			fmt.Printf("\n===== batch %d of %d: %s =====\n", batch.Batch, batch.Of, strings.Join(batch.Nodes, ", "))
+		case orchestrator.FleetResultEvent:
+			var result orchestrator.FleetNodeResult
+			if err := json.Unmarshal(data, &result); err != nil {
+				return err
+			}
+			printFleetResult(&result)
+		case hook.EventDone:
+			r, err := parseFleetReport(data)
+			if err != nil {
+				return err
+			}
+			report = r
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if report == nil {
+		return nil, fmt.Errorf("fleet stream ended before every node finished")
+	}
+	return report, nil
+}
+
+func CancelJob(addr string, node string, job string, headers map[string]string) ([]byte, error) {
+	url := fmt.Sprintf("https://%s/%s/jobs/%s", addr, node, job)
+	return DoDeleteRequest(url, headers)
 }
 
 func RequestData(addr string, node string, path string, headers map[string]string) ([]byte, error) {
@@ -113,15 +391,21 @@ func DoGetRequest(url string, headers map[string]string) ([]byte, error) {
 	return body, nil
 }
 
-func DoPostRequest(url string, data map[string]interface{}, headers map[string]string) error {
+func DoPostRequest(url string, data map[string]interface{}, headers map[string]string) ([]byte, error) {
+	body, _, err := doPostRequest(url, data, headers)
+	return body, err
+}
+
+// Post data as json, returning the body and headers of the response
+func doPostRequest(url string, data map[string]interface{}, headers map[string]string) ([]byte, http.Header, error) {
 	serial, err := json.Marshal(data)
 	if err != nil {
-		return err
+		return nil, nil, err
 	}
 	req, err := http.NewRequest("POST", url, bytes.NewBuffer(serial))
 	if err != nil {
 		fmt.Println(err)
-		return err
+		return nil, nil, err
 	}
 	req.Header.Set("Content-Type", "application/json")
 	for k, v := range headers {
@@ -141,19 +425,71 @@ func DoPostRequest(url string, data map[string]interface{}, headers map[string]s
 	resp, err := client.Do(req)
 	if err != nil {
 		fmt.Println(err)
-		return err
-	}
-	if resp.StatusCode != http.StatusOK {
-		fmt.Printf("Bad request: %s\nReq:\n%+v\n", resp.Status, req)
-		return fmt.Errorf("post request not OK: %d", resp.StatusCode)
+		return nil, nil, err
 	}
 
 	// Process the response body
 	body, err := io.ReadAll(resp.Body)
 	if err != nil {
-		return err
+		return nil, nil, err
 	}
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusAccepted {
+		fmt.Printf("Bad request: %s\n%s\n", resp.Status, body)
+		return nil, nil, fmt.Errorf("post request not OK: %d", resp.StatusCode)
+	}
+
+	return body, resp.Header, nil
+}
+
+func parseJob(body []byte) (*gnode.Job, error) {
+	var job gnode.Job
+	if err := json.Unmarshal(body, &job); err != nil {
+		return nil, fmt.Errorf("unable to parse job from response: %w", err)
+	}
+	return &job, nil
+}
 
-	fmt.Printf("%s\n\n", body)
-	return nil
+func parseFleetReport(body []byte) (*orchestrator.FleetReport, error) {
+	var report orchestrator.FleetReport
+	if err := json.Unmarshal(body, &report); err != nil {
+		return nil, fmt.Errorf("unable to parse fleet report from response: %w", err)
+	}
+	return &report, nil
+}
+
+func DoDeleteRequest(url string, headers map[string]string) ([]byte, error) {
+	// Prepare the request
+	req, err := http.NewRequest("DELETE", url, nil)
+	if err != nil {
+		fmt.Println(err)
+		return nil, err
+	}
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+
+	// Do the request
+	client := &http.Client{
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{
+				InsecureSkipVerify: true,
+			},
+		},
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		fmt.Println(err)
+		return nil, err
+	}
+
+	// Read the response body
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("delete request not OK: %d; %s", resp.StatusCode, body)
+	}
+
+	return body, nil
 }
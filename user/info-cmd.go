@@ -18,6 +18,10 @@ var infoCommand = cli.Command{
 			Usage: "Specify the address of the gorch orchestrator",
 			Value: "127.0.0.1:443",
 		},
+		&cli.StringFlag{
+			Name:  "selector",
+			Usage: "Only show nodes with matching labels. Formatted like 'role=builder,region!=eu'",
+		},
 		&cli.BoolFlag{
 			Name:    "json",
 			Aliases: []string{"j"},
@@ -26,7 +30,7 @@ var infoCommand = cli.Command{
 		},
 	},
 	Action: func(c *cli.Context) error {
-		raw, err := GetNodes(c.String("orchestrator"))
+		raw, err := GetNodes(c.String("orchestrator"), c.String("selector"))
 		if err != nil {
 			fmt.Printf("Request Error: %s", err)
 			return err